@@ -0,0 +1,91 @@
+package ursa
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// What a route does with the requests it matches. See Action of [ursa.Route]
+type Action int
+
+const (
+	LimitAction       Action = iota // Rate limit the requests using the rates of the route
+	AllowAction                     // Send the requests upstream without rate limiting them
+	DenyAction                      // Respond with Status and Body of the route
+	MaintenanceAction               // Respond with 503 and a Retry-After header
+)
+
+const (
+	// Status code of the responses of routes with DenyAction that don't set
+	// Status
+	DefaultDenyStatus = http.StatusForbidden
+	// Time after which clients are told to try again by routes with
+	// MaintenanceAction that don't set RetryAfter
+	DefaultMaintenanceRetryAfter = 5 * time.Minute
+)
+
+// Template of the fallback route of a configuration, which is used to set
+// [ursa.Overrides] for the fallback route. See Fallback of [ursa.Conf]
+const FallbackRouteKey = "*"
+
+// Pattern of the fallback route, which matches every path
+var fallbackPattern = regexp.MustCompile(".*")
+
+// Returns the fallback route of the configuration ready to be used by the
+// server, or nil if it has none
+func fallbackRoute(conf Conf) *Route {
+	if conf.Fallback == nil {
+		return nil
+	}
+	fallback := *conf.Fallback
+	fallback.Methods = []string{AnyMethod}
+	fallback.Template, fallback.Pattern = FallbackRouteKey, fallbackPattern
+	return &fallback
+}
+
+// Responds to the request as told by the action of the route, which is
+// expected to be DenyAction or MaintenanceAction
+func serveAction(w http.ResponseWriter, route *Route) {
+	if route.Action == DenyAction {
+		status := route.Status
+		if status == 0 {
+			status = DefaultDenyStatus
+		}
+		WriteProblem(w, Problem{Type: ProblemDenied, Status: status, Detail: route.Body})
+		return
+	}
+	retryAfter := route.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	detail := route.Body
+	if detail == "" {
+		detail = fmt.Sprintf("Under maintenance. Try again in %v seconds", seconds)
+	}
+	WriteProblem(w, Problem{
+		Type:       ProblemMaintenance,
+		Status:     http.StatusServiceUnavailable,
+		Detail:     detail,
+		RetryAfter: seconds,
+	})
+}
+
+// Checks the fields of the route that tell what is done with the requests it
+// matches
+func validateAction(r Route, add func(field string, format string, args ...any)) {
+	if r.Action < LimitAction || r.Action > MaintenanceAction {
+		add("Action", "invalid action %v", r.Action)
+	}
+	if r.Status != 0 && r.Action != DenyAction {
+		add("Status", "status is only used by routes with DenyAction")
+	} else if r.Status != 0 && (r.Status < 100 || r.Status > 599) {
+		add("Status", "invalid status code %v", r.Status)
+	}
+	if r.RetryAfter < 0 {
+		add("RetryAfter", "retry after can't be negative, not %v", r.RetryAfter)
+	}
+}
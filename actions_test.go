@@ -0,0 +1,133 @@
+package ursa
+
+import (
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestRouteActions(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	one := RouteRates{RateByIP: NewRate(1, Hour)}
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Groups: []RouteGroup{{
+			Methods: []string{"GET"},
+			Rates:   one,
+			Routes: []Route{
+				{Template: "/health", Action: AllowAction},
+				{Template: "/admin/*", Action: DenyAction, Status: 404, Body: "not found"},
+				{Template: "/legacy", Action: DenyAction},
+				{Template: "/reports", Action: MaintenanceAction, RetryAfter: 90 * time.Second},
+				{Template: "/billing", Action: MaintenanceAction, Body: "back soon"},
+				{Template: "/limited"},
+			},
+		}},
+		Fallback: &Route{Rates: RouteRates{RateByIP: NewRate(2, Hour)}},
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		method        string
+		url           string
+		expCode       int
+		expBody       string
+		expDetail     string
+		expRetryAfter string
+	}
+	tests := []test{
+		{method: "GET", url: "/health", expCode: 200, expBody: "ok"},
+		{method: "GET", url: "/health", expCode: 200, expBody: "ok"},
+		{method: "GET", url: "/admin/users", expCode: 404, expDetail: "not found"},
+		{method: "GET", url: "/legacy", expCode: DefaultDenyStatus},
+		{method: "GET", url: "/reports", expCode: 503, expRetryAfter: "90"},
+		{method: "GET", url: "/billing", expCode: 503, expDetail: "back soon", expRetryAfter: "300"},
+		{method: "GET", url: "/limited", expCode: 200},
+		{method: "GET", url: "/limited", expCode: 429},
+		// The fallback route is used for the requests no route matches, and
+		// its bucket is shared by all of them
+		{method: "POST", url: "/health", expCode: 200},
+		{method: "GET", url: "/other", expCode: 200},
+		{method: "DELETE", url: "/other/path", expCode: 429},
+	}
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(test.method, test.url, nil))
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+		if test.expBody != "" && rec.Body.String() != test.expBody {
+			t.Errorf("case %d: expected body %q got %q", i, test.expBody, rec.Body.String())
+		}
+		if got := problemOf(rec).Detail; test.expDetail != "" && got != test.expDetail {
+			t.Errorf("case %d: expected detail %q got %q", i, test.expDetail, got)
+		}
+		if got := rec.Header().Get("Retry-After"); test.expRetryAfter != "" && got != test.expRetryAfter {
+			t.Errorf("case %d: expected Retry-After %q got %q", i, test.expRetryAfter, got)
+		}
+	}
+}
+
+func TestValidateActions(t *testing.T) {
+	route := func(r Route) Conf {
+		r.Methods = []string{"GET"}
+		r.Template = "/a"
+		return Conf{Upstream: upstream(), Routes: []Route{r}}
+	}
+	type test struct {
+		conf        Conf
+		expField    string
+		description string
+	}
+	tests := []test{
+		{conf: route(Route{Action: DenyAction}), description: "deny without rates"},
+		{conf: route(Route{Action: MaintenanceAction, RetryAfter: time.Hour}), description: "maintenance"},
+		{conf: route(Route{}), expField: "Rates", description: "limit without rates"},
+		{conf: route(Route{Action: Action(7)}), expField: "Action", description: "unknown action"},
+		{conf: route(Route{Action: DenyAction, Status: 1000}), expField: "Status", description: "invalid status"},
+		{conf: route(Route{Action: AllowAction, Status: 403}), expField: "Status", description: "status without deny"},
+		{conf: route(Route{Action: MaintenanceAction, RetryAfter: -time.Second}), expField: "RetryAfter", description: "negative retry after"},
+		{
+			conf: Conf{
+				Upstream: upstream(),
+				Routes:   []Route{{Methods: []string{"GET"}, Template: "/a", Action: AllowAction}},
+				Fallback: &Route{Action: DenyAction},
+			},
+			description: "fallback that denies",
+		},
+		{
+			conf: Conf{
+				Upstream: upstream(),
+				Routes:   []Route{{Methods: []string{"GET"}, Template: "/a", Action: AllowAction}},
+				Fallback: &Route{},
+			},
+			expField:    "Fallback.Rates",
+			description: "fallback without rates",
+		},
+		{
+			conf: Conf{
+				Upstream: upstream(),
+				Routes:   []Route{{Methods: []string{"GET"}, Template: "/a", Action: AllowAction}},
+				Fallback: &Route{Pattern: regexp.MustCompile("^/"), Action: AllowAction},
+			},
+			expField:    "Fallback",
+			description: "fallback with pattern",
+		},
+	}
+	for _, test := range tests {
+		errs := Validate(test.conf)
+		if test.expField == "" && errs != nil {
+			t.Errorf("case %v: expected no errors got %v", test.description, errs)
+		}
+		if test.expField != "" && (len(errs) != 1 || errs[0].Field != test.expField) {
+			t.Errorf("case %v: expected error in %v got %v", test.description, test.expField, errs)
+		}
+	}
+}
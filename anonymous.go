@@ -0,0 +1,87 @@
+package ursa
+
+import (
+	"context"
+	"net/http"
+)
+
+// What is done with the requests to a route that carry none of the values
+// the RateBys of the route look for, like a request without a token to a
+// route that only rate limits by token. See [ursa.Anonymous]
+type AnonymousPolicy int
+
+const (
+	// Respond with Status and Body of [ursa.Anonymous]
+	RejectAnonymous AnonymousPolicy = iota
+	// Rate limit each client by IP using Rate of [ursa.Anonymous]
+	LimitAnonymousByIP
+	// Rate limit all the anonymous clients together, as if they were one
+	// client, using Rate of [ursa.Anonymous]
+	LimitAnonymousTogether
+	// Send the requests upstream without rate limiting them
+	AllowAnonymous
+)
+
+// Anonymous tells what is done with the requests to a route that carry none
+// of the values the RateBys of the route look for. Routes that have
+// [ursa.RateByIP] in their Rates never have such requests, as any request can
+// be rate limited by IP.
+//
+// By default the requests are rejected with Status, which defaults to
+// [ursa.HeaderValueNotFoundInRequestForRateLimiting], and a
+// [ursa.ProblemMissingValue] problem with Body, if any, as its detail.
+// Clients on their plan or with an override for the route get their own rate
+// even when limited as anonymous clients.
+type Anonymous struct {
+	Policy AnonymousPolicy
+	Rate   Rate // Rate for LimitAnonymousByIP and LimitAnonymousTogether
+	Status int  // Status code of the response for RejectAnonymous
+	Body   string
+}
+
+// RateBy of the requests limited by LimitAnonymousTogether. Its signature is
+// the same for every request so that all of them share a box.
+var anonymousRateBy = NewRateByExtractor("anonymous",
+	ExtractorFunc(func(context.Context, *http.Request) (string, error) { return "", nil }),
+	http.StatusBadRequest, "")
+
+// Returns the RateBy that anonymous requests to the route are rate limited
+// by, or nil if they aren't rate limited
+func (r *Route) anonymousRateBy() *RateBy {
+	switch r.Anonymous.Policy {
+	case LimitAnonymousByIP:
+		return RateByIP
+	case LimitAnonymousTogether:
+		return anonymousRateBy
+	}
+	return nil
+}
+
+// Returns the error to respond to anonymous requests with when they are
+// rejected
+func (a Anonymous) rejection() *ErrReqSignature {
+	status := a.Status
+	if status == 0 {
+		status = HeaderValueNotFoundInRequestForRateLimiting
+	}
+	return &ErrReqSignature{Code: status, Message: a.Body, Type: ProblemMissingValue}
+}
+
+func validateAnonymous(a Anonymous, add func(field string, format string, args ...any)) {
+	switch a.Policy {
+	case RejectAnonymous:
+		if a.Status != 0 && (a.Status < 100 || a.Status > 599) {
+			add("Anonymous", "invalid status code %v", a.Status)
+		}
+	case LimitAnonymousByIP, LimitAnonymousTogether:
+		if err := validateRate(a.Rate); err != nil {
+			add("Anonymous", "rate: %v", err)
+		}
+	case AllowAnonymous:
+	default:
+		add("Anonymous", "invalid anonymous policy %v", a.Policy)
+	}
+	if a.Policy != RejectAnonymous && (a.Status != 0 || a.Body != "") {
+		add("Anonymous", "status and body are only used by RejectAnonymous")
+	}
+}
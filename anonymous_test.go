@@ -0,0 +1,126 @@
+package ursa
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnonymous(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	byUser := NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 400, "")
+	route := func(template string, anonymous Anonymous) Route {
+		return Route{
+			Methods:   []string{"GET"},
+			Template:  template,
+			Rates:     RouteRates{byUser: NewRate(1, Hour)},
+			Anonymous: anonymous,
+		}
+	}
+	two := NewRate(2, Hour)
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			route("/default", Anonymous{}),
+			route("/reject", Anonymous{Status: 403, Body: "log in first"}),
+			route("/ip", Anonymous{Policy: LimitAnonymousByIP, Rate: two}),
+			route("/together", Anonymous{Policy: LimitAnonymousTogether, Rate: two}),
+			route("/allow", Anonymous{Policy: AllowAnonymous}),
+		},
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		path      string
+		user      string
+		ip        string
+		expCode   int
+		expBody   string
+		expDetail string
+	}
+	tests := []test{
+		{path: "/default", expCode: HeaderValueNotFoundInRequestForRateLimiting},
+		{path: "/default", user: "alice", expCode: 200},
+		{path: "/reject", expCode: 403, expDetail: "log in first"},
+		// Each IP has its own bucket
+		{path: "/ip", ip: "10.0.0.1", expCode: 200},
+		{path: "/ip", ip: "10.0.0.1", expCode: 200},
+		{path: "/ip", ip: "10.0.0.1", expCode: 429},
+		{path: "/ip", ip: "10.0.0.2", expCode: 200},
+		// Users keep the rate of their RateBy
+		{path: "/ip", user: "alice", expCode: 200},
+		{path: "/ip", user: "alice", expCode: 429},
+		// All anonymous clients share a bucket
+		{path: "/together", ip: "10.0.0.1", expCode: 200},
+		{path: "/together", ip: "10.0.0.2", expCode: 200},
+		{path: "/together", ip: "10.0.0.3", expCode: 429},
+		{path: "/together", user: "bob", expCode: 200},
+		{path: "/allow", expCode: 200},
+		{path: "/allow", expCode: 200},
+		{path: "/allow", user: "bob", expCode: 200},
+		{path: "/allow", user: "bob", expCode: 429},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.Header.Set("User", test.user)
+		}
+		if test.ip != "" {
+			r.RemoteAddr = test.ip + ":1234"
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+		if test.expBody != "" && rec.Body.String() != test.expBody {
+			t.Errorf("case %d: expected body %q got %q", i, test.expBody, rec.Body.String())
+		}
+		if got := problemOf(rec).Detail; test.expDetail != "" && got != test.expDetail {
+			t.Errorf("case %d: expected detail %q got %q", i, test.expDetail, got)
+		}
+	}
+
+	// Buckets of anonymous clients are kept when the configuration is
+	// reloaded
+	if err := s.Reload(conf); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/together", nil)
+	if got := statusOf(s, r); got != 429 {
+		t.Errorf("expected the shared bucket to be kept after reload, got code %v", got)
+	}
+}
+
+func TestValidateAnonymous(t *testing.T) {
+	type test struct {
+		anonymous   Anonymous
+		valid       bool
+		description string
+	}
+	tests := []test{
+		{anonymous: Anonymous{}, valid: true, description: "default"},
+		{anonymous: Anonymous{Status: 403, Body: "no"}, valid: true, description: "reject"},
+		{anonymous: Anonymous{Policy: LimitAnonymousByIP, Rate: NewRate(5, Minute)}, valid: true, description: "by ip"},
+		{anonymous: Anonymous{Policy: LimitAnonymousTogether}, description: "no rate"},
+		{anonymous: Anonymous{Policy: AllowAnonymous, Status: 403}, description: "status without reject"},
+		{anonymous: Anonymous{Status: 42}, description: "invalid status"},
+		{anonymous: Anonymous{Policy: AnonymousPolicy(9)}, description: "unknown policy"},
+	}
+	for _, test := range tests {
+		conf := ValidConfSingleRoute()
+		conf.Routes[0].Anonymous = test.anonymous
+		errs := Validate(conf)
+		if test.valid && errs != nil {
+			t.Errorf("case %v: expected no errors got %v", test.description, errs)
+		}
+		if !test.valid && (len(errs) != 1 || errs[0].Field != "Anonymous") {
+			t.Errorf("case %v: expected error in Anonymous got %v", test.description, errs)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package ursa
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A registry of API keys issued to clients, loaded from a file using
+// [ursa.LoadAPIKeyRegistry]. The file is a JSON document of the form:
+//
+//	{
+//		"keys": [
+//			{"id": "acme", "hash": "sha256:9f86d08...", "plan": "pro"},
+//			{"id": "globex", "key": "plain-text-key", "plan": "free"},
+//			{"id": "initech", "hash": "sha256:60303ae...", "revoked": true}
+//		]
+//	}
+//
+// Each key has an id which is used as the signature of the requests made with
+// the key, so that a client whose key is rotated keeps the same buckets. Keys
+// may be stored either in plain text (key) or as hex encoded SHA-256 hashes
+// (hash). The plan of the key decides the rate that applies to the client on
+// the routes that have a rate for the plan in their PlanRates.
+//
+// APIKeyRegistry is safe for concurrent use.
+type APIKeyRegistry struct {
+	path    string
+	modTime time.Time
+	size    int64
+	byHash  map[string]apiKey // Maps hex encoded sha256 hash of key to the key
+	plans   map[string]string // Maps id to the plan of the key
+	sync.RWMutex
+}
+
+type apiKey struct {
+	ID      string `json:"id"`
+	Key     string `json:"key"`
+	Hash    string `json:"hash"`
+	Plan    string `json:"plan"`
+	Revoked bool   `json:"revoked"`
+}
+
+// Load the API key registry from the file at path. See [ursa.APIKeyRegistry]
+// for the format of the file.
+func LoadAPIKeyRegistry(path string) (*APIKeyRegistry, error) {
+	reg := &APIKeyRegistry{path: path}
+	if err := reg.Reload(); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Reload reads the registry file again. If the file can't be read or is
+// invalid, the keys loaded previously are kept and an error is returned.
+func (reg *APIKeyRegistry) Reload() error {
+	info, err := os.Stat(reg.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(reg.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%v: %w", reg.path, err)
+	}
+	byHash := make(map[string]apiKey)
+	plans := make(map[string]string)
+	for i, k := range file.Keys {
+		hash := strings.ToLower(strings.TrimPrefix(k.Hash, "sha256:"))
+		if k.Key != "" {
+			hash = hashAPIKey(k.Key)
+		}
+		if len(hash) != sha256.Size*2 {
+			return fmt.Errorf("%v: key %d: neither key nor a valid sha256 hash given", reg.path, i)
+		}
+		if k.ID == "" {
+			k.ID = hash
+		}
+		k.Key = ""
+		byHash[hash] = k
+		plans[k.ID] = k.Plan
+	}
+	reg.Lock()
+	reg.byHash = byHash
+	reg.plans = plans
+	reg.modTime = info.ModTime()
+	reg.size = info.Size()
+	reg.Unlock()
+	return nil
+}
+
+// Watch checks the registry file for changes every interval and reloads it
+// when it changes. Errors that occur when reloading are passed to onError
+// which may be nil. Call the returned function to stop watching, it returns
+// once the watcher has stopped.
+func (reg *APIKeyRegistry) Watch(interval time.Duration, onError func(error)) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(reg.path)
+			if err == nil {
+				reg.RLock()
+				changed := !info.ModTime().Equal(reg.modTime) || info.Size() != reg.size
+				reg.RUnlock()
+				if !changed {
+					continue
+				}
+				err = reg.Reload()
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// Returns the id of the given key if the key is known and not revoked
+func (reg *APIKeyRegistry) lookup(key string) (string, error) {
+	reg.RLock()
+	k, ok := reg.byHash[hashAPIKey(key)]
+	reg.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown api key: %w", ErrInvalidValue)
+	}
+	if k.Revoked {
+		return "", fmt.Errorf("api key %v revoked: %w", k.ID, ErrInvalidValue)
+	}
+	return k.ID, nil
+}
+
+// Plan returns the plan of the key with the given id. This makes
+// APIKeyRegistry a [ursa.PlanResolver].
+func (reg *APIKeyRegistry) Plan(id string) (string, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	plan, ok := reg.plans[id]
+	return plan, ok && plan != ""
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyExtractor struct {
+	header string
+	reg    *APIKeyRegistry
+}
+
+func (e apiKeyExtractor) Extract(_ context.Context, r *http.Request) (string, error) {
+	key := r.Header.Get(e.header)
+	if key == "" {
+		return "", ErrNoValue
+	}
+	return e.reg.lookup(key)
+}
+
+// Create a RateBy that performs rate limiting by the API key in the given
+// header. Requests with unknown or revoked keys are responded with failCode
+// and failMsg. The id of the key in the registry is used as the signature and
+// the registry is used as the PlanResolver of the RateBy so that the plan of
+// each key chooses the rate that applies to it.
+func NewRateByAPIKey(header string, reg *APIKeyRegistry, failCode int, failMsg string) *RateBy {
+	by := NewRateByExtractor("apikey:"+header, apiKeyExtractor{header, reg}, failCode, failMsg)
+	by.Plans = reg
+	return by
+}
@@ -0,0 +1,92 @@
+package ursa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func writeAPIKeyRegistry(t *testing.T, path string, proKeyPlan string) {
+	data := fmt.Sprintf(`{"keys": [
+		{"id": "acme", "hash": "sha256:%s", "plan": %q},
+		{"id": "globex", "key": "globex-key", "plan": "free"},
+		{"id": "initech", "key": "initech-key", "revoked": true},
+		{"key": "anonymous-key"}
+	]}`, hashAPIKey("acme-key"), proKeyPlan)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeyRateBy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeAPIKeyRegistry(t, path, "pro")
+	reg, err := LoadAPIKeyRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	by := NewRateByAPIKey("X-API-Key", reg, http.StatusUnauthorized, "Invalid API key")
+
+	freeRate := NewRate(10, Minute)
+	proRate := NewRate(100, Minute)
+	defaultRate := NewRate(5, Minute)
+	route := &Route{
+		Pattern:   regexp.MustCompile("/"),
+		Rates:     RouteRates{by: defaultRate},
+		PlanRates: map[string]Rate{"free": freeRate, "pro": proRate},
+	}
+
+	type test struct {
+		key     string
+		expSig  string
+		expErr  error
+		expRate Rate
+	}
+	tests := []test{
+		{key: "", expErr: ErrNoValue},
+		{key: "acme-key", expSig: "acme", expRate: proRate},
+		{key: "globex-key", expSig: "globex", expRate: freeRate},
+		{key: "initech-key", expErr: ErrInvalidValue},
+		{key: "unknown-key", expErr: ErrInvalidValue},
+		{key: "anonymous-key", expSig: hashAPIKey("anonymous-key"), expRate: defaultRate},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if test.key != "" {
+			r.Header.Set("X-API-Key", test.key)
+		}
+		sig, err := by.Extract(context.Background(), r)
+		if !errors.Is(err, test.expErr) || (test.expErr == nil && err != nil) {
+			t.Errorf("key %q: expected error %v got %v", test.key, test.expErr, err)
+		}
+		if sig != test.expSig {
+			t.Errorf("key %q: expected signature %q got %q", test.key, test.expSig, sig)
+		}
+		if err == nil {
+			if got := rateFor(&Conf{}, route, by, sig); got != test.expRate {
+				t.Errorf("key %q: expected rate %v got %v", test.key, test.expRate, got)
+			}
+		}
+	}
+
+	// Changing the plan in the file is picked up by the watcher
+	stop := reg.Watch(5*time.Millisecond, func(err error) { t.Error(err) })
+	defer stop()
+	// Ensure the modification time differs on file systems with coarse mtime
+	later := time.Now().Add(time.Second)
+	writeAPIKeyRegistry(t, path, "free")
+	os.Chtimes(path, later, later)
+	deadline := time.Now().Add(time.Second)
+	for rateFor(&Conf{}, route, by, "acme") != freeRate && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := rateFor(&Conf{}, route, by, "acme"); got != freeRate {
+		t.Errorf("expected rate %v after reload got %v", freeRate, got)
+	}
+}
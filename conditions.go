@@ -0,0 +1,137 @@
+package ursa
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Returns the host of the request in lower case, without the port and the
+// trailing dot of a fully qualified name.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Checks if Host of a route is valid. A host is a name like api.example.com,
+// optionally starting with *. to match any subdomain.
+func validateHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/:") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return nil
+}
+
+// Returns whether the host of a request matches Host of a route. An empty
+// pattern matches any host.
+func hostMatches(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+	return host == pattern
+}
+
+// Returns whether the route has conditions on the request other than its
+// path, method and host, which can't be decided from the path alone.
+func (r *Route) hasRequestConditions() bool {
+	return len(r.Headers) > 0 || len(r.Query) > 0 || r.ContentType != ""
+}
+
+// Returns whether the request meets the Headers, Query and ContentType
+// conditions of the route
+func (r *Route) matchesRequest(req *http.Request) bool {
+	for name, pattern := range r.Headers {
+		if !anyMatches(pattern, req.Header.Values(name)) {
+			return false
+		}
+	}
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for name, pattern := range r.Query {
+			if !anyMatches(pattern, query[name]) {
+				return false
+			}
+		}
+	}
+	if r.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || !contentTypeMatches(r.ContentType, mediaType) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether any of the values matches the pattern. A nil pattern
+// matches any value.
+func anyMatches(pattern *regexp.Regexp, values []string) bool {
+	for _, v := range values {
+		if pattern == nil || pattern.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the media type matches the content type of a route, which
+// can end with /* to match any subtype
+func contentTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	}
+	return mediaType == pattern
+}
+
+// Checks if ContentType of a route is valid
+func validateContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || len(params) > 0 || !strings.Contains(mediaType, "/") {
+		return fmt.Errorf("invalid content type %q", contentType)
+	}
+	return nil
+}
+
+// Returns the part of the bucket id that tells apart routes with the same
+// host and path but different conditions on the request
+func conditionsKey(r *Route) string {
+	if !r.hasRequestConditions() {
+		return ""
+	}
+	var conds []string
+	for name, pattern := range r.Headers {
+		conds = append(conds, "header:"+http.CanonicalHeaderKey(name)+"="+regexpString(pattern))
+	}
+	for name, pattern := range r.Query {
+		conds = append(conds, "query:"+name+"="+regexpString(pattern))
+	}
+	if r.ContentType != "" {
+		conds = append(conds, "content-type:"+strings.ToLower(r.ContentType))
+	}
+	sort.Strings(conds)
+	return "[" + strings.Join(conds, " ") + "]"
+}
+
+func regexpString(r *regexp.Regexp) string {
+	if r == nil {
+		return ""
+	}
+	return r.String()
+}
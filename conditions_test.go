@@ -0,0 +1,95 @@
+package ursa
+
+import (
+	"io"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRouteConditions(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	one := RouteRates{RateByIP: NewRate(1, Hour)}
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			{Methods: []string{"GET"}, Template: "/v1", Host: "admin.example.com", Rates: one},
+			{Methods: []string{"GET"}, Template: "/v1", Host: "*.example.com", Rates: one},
+			{
+				Methods:     []string{"POST"},
+				Template:    "/upload",
+				ContentType: "image/*",
+				Rates:       one,
+			},
+			{
+				Methods:  []string{"GET"},
+				Template: "/beta",
+				Headers:  map[string]*regexp.Regexp{"X-Beta": regexp.MustCompile(`^(1|true)$`)},
+				Rates:    one,
+			},
+			{
+				Methods:  []string{"GET"},
+				Template: "/search",
+				Query:    map[string]*regexp.Regexp{"debug": nil},
+				Rates:    one,
+			},
+			// Catches requests to /beta without the header
+			{Methods: []string{"GET"}, Pattern: regexp.MustCompile(`^/beta`), Rates: one},
+		},
+	}
+	if hasError := ValidateConf(conf, false); hasError {
+		t.Fatal("expected configuration to be valid")
+	}
+	s := New(conf)
+
+	type test struct {
+		method  string
+		url     string
+		header  map[string]string
+		expCode int
+	}
+	tests := []test{
+		{method: "GET", url: "http://admin.example.com/v1", expCode: 200},
+		{method: "GET", url: "http://admin.example.com:8080/v1", expCode: 429},
+		// All subdomains share the bucket of the wildcard route
+		{method: "GET", url: "http://api.example.com/v1", expCode: 200},
+		{method: "GET", url: "http://API.example.com./v1", expCode: 429},
+		{method: "GET", url: "http://a.b.example.com/v1", expCode: 429},
+		// The wildcard doesn't match the domain itself
+		{method: "GET", url: "http://example.com/v1", expCode: 200},
+		{method: "GET", url: "http://example.com/v1", expCode: 200},
+		{method: "POST", url: "/upload", header: map[string]string{"Content-Type": "image/png"}, expCode: 200},
+		{method: "POST", url: "/upload", header: map[string]string{"Content-Type": "IMAGE/jpeg; q=1"}, expCode: 429},
+		{method: "POST", url: "/upload", header: map[string]string{"Content-Type": "text/plain"}, expCode: 200},
+		{method: "POST", url: "/upload", expCode: 200},
+		{method: "GET", url: "/beta", header: map[string]string{"X-Beta": "true"}, expCode: 200},
+		{method: "GET", url: "/beta", header: map[string]string{"X-Beta": "1"}, expCode: 429},
+		{method: "GET", url: "/beta", header: map[string]string{"X-Beta": "no"}, expCode: 200},
+		{method: "GET", url: "/beta", expCode: 429},
+		{method: "GET", url: "/search?debug", expCode: 200},
+		{method: "GET", url: "/search?debug=1", expCode: 429},
+		{method: "GET", url: "/search?q=1", expCode: 200},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		for k, v := range test.header {
+			r.Header.Set(k, v)
+		}
+		if got := statusOf(s, r); got != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, got)
+		}
+	}
+
+	conf.Routes[0].Host = "api.*.com"
+	if hasError := ValidateConf(conf, false); !hasError {
+		t.Error("expected configuration with invalid host to be invalid")
+	}
+	conf.Routes[0].Host = ""
+	conf.Routes[2].ContentType = "image"
+	if hasError := ValidateConf(conf, false); !hasError {
+		t.Error("expected configuration with invalid content type to be invalid")
+	}
+}
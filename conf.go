@@ -1,12 +1,18 @@
 package ursa
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
-// Configuration to provide when creating server using [ursa.New]
+// Configuration to provide when creating server using [ursa.New]. The
+// configuration of a running server can be replaced using its Reload method.
 //
 // Upstream is the url of the backend that the requests should be proxied for.
 // Note that you can only specify one upstream
@@ -16,19 +22,83 @@ import (
 // If request doesn't match any of the Routes (request path & request method), it is
 // sent upstream without any rate liming.
 //
-// Logfile is an io.Writer where the logs should be written
+// Logfile is an io.Writer where the logs should be written.
+//
+// Plans tells the plan of each client for the RateBys that don't have a
+// PlanResolver of their own. The rate for the plan of a client on a route is
+// looked up in PlanRates of the route. When the plan of a client changes, the
+// buckets of the client are resized on their next request.
+//
+// Overrides holds temporary rates for individual clients that take precedence
+// over their plans and the rates of the routes. See [ursa.Overrides]
+//
+// RouteCacheSize is the number of distinct request paths and methods for
+// which the matching route is remembered. The least recently used ones are
+// forgotten first. Defaults to [ursa.DefaultRouteCacheSize]
+//
+// PathNormalization tells how the path of a request is normalized before it
+// is matched to a route. See [ursa.PathNormalization]
+//
+// MethodOverride tells what to do with requests that have a method override
+// header like X-HTTP-Method-Override. By default the header is removed so
+// that it can't be used to match a route with a different method than the
+// one upstream acts on. See [ursa.MethodOverride]
+//
+// CustomMethods lists the methods other than the standard HTTP methods, like
+// PURGE or PROPFIND, that can be used in Methods of the routes.
+//
+// Groups holds routes that share a path prefix and defaults for their methods
+// and rates. They are flattened into ordinary routes that come before Routes.
+// See [ursa.RouteGroup]
+//
+// Fallback, if set, is used for the requests that don't match any route,
+// which are otherwise sent upstream without rate limiting. Only its rates and
+// action are used, it matches every path and method. Its buckets are shared
+// by all the paths, and it can be given overrides using
+// [ursa.FallbackRouteKey] as the route.
+//
+// RateLimitHeaders tells which headers are added to the responses to let
+// clients know their limits. See [ursa.RateLimitHeaders]
+//
+// RejectionHandler responds to the requests rejected because their client
+// ran out of tokens, on the routes that don't have a RejectionHandler of
+// their own. Defaults to [ursa.DefaultRejectionHandler]. See
+// [ursa.NewRejectionResponder] for responses in the format the client asks
+// for.
 type Conf struct {
-	Upstream *url.URL
-	Routes   []Route
-	Logfile  io.Writer
+	Upstream          *url.URL
+	Routes            []Route
+	Groups            []RouteGroup
+	Fallback          *Route
+	Logfile           io.Writer
+	Plans             PlanResolver
+	Overrides         *Overrides
+	RouteCacheSize    int
+	PathNormalization PathNormalization
+	MethodOverride    MethodOverride
+	CustomMethods     []string
+	RateLimitHeaders  RateLimitHeaders
+	RejectionHandler  RejectionHandler
 }
 
 // A Route describes the rules of rate limiting for urls matched by the regex Pattern
 // of the route.
 //
+// Instead of a Pattern, a route can have a Template, a path whose segments
+// are either literal, a param written as {name} that matches any one segment,
+// or a * as the last segment that matches the rest of the path. For example
+// "/tenants/{tenant}/users" or "/static/*". Unlike patterns, templates match
+// the whole path. Routes with templates are matched using a tree, so the time
+// it takes to match them doesn't grow with the number of routes. Params of
+// the template can be used in BucketBy like named capture groups of a
+// pattern. If both are set, Template is used.
+//
 // Methods is a slice of strings representing method names to match. Method
-// names can be arbitrary. Method names are case insensetive. At least one method
-// must be defined.
+// names are case insensitive. Besides the standard HTTP methods and the ones
+// in CustomMethods of [ursa.Conf], an entry can be [ursa.AnyMethod] or "*" to
+// match every method, or a group like [ursa.SafeMethods] or
+// [ursa.MutatingMethods]. A method can't be listed more than once, including
+// through a group. At least one method must be defined.
 //
 // Rates is a map ([ursa.RouteRates]) that maps describes the different rates for different
 // RateBys for the route. This is useful for example if on the api/product/ route you want
@@ -36,8 +106,295 @@ type Conf struct {
 // case you'll probably use the [ursa.RateBy IP] as as RateBy to describe rate for non
 // authenticated users and another RateBy created using [ursa.NewRateBy] for authenticated
 // users
+//
+// PlanRates maps plan names to the rate that applies on the route to clients
+// on that plan. It is used for clients whose plan is known to the PlanResolver
+// of the RateBy, such as the one created using [ursa.NewRateByAPIKey], or to
+// Plans of [ursa.Conf]. Clients whose plan has no rate in PlanRates get the
+// rate in Rates.
+//
+// By default all requests of a client that match a route share one bucket.
+// BucketBy lists names of capture groups in Pattern whose values become part
+// of the bucket, so that for example with the pattern
+// `^/tenants/(?P<tenant>[^/]+)` and BucketBy []string{"tenant"}, a client
+// gets a separate bucket for each tenant. To limit the requests to a tenant
+// as a whole instead, see [ursa.NewRateByPathParam]
+//
+// A route can also be limited to some requests, so that one server can have
+// different limits for the same path on different hosts, for example:
+//
+//   - Host matches the host of the request, like "api.example.com". A host
+//     starting with "*." like "*.example.com" matches any subdomain. The port
+//     is ignored.
+//   - Headers maps header names to a regex that one of the values of the
+//     header must match. A nil regex only requires the header to be present.
+//   - Query does the same for query parameters.
+//   - ContentType matches the media type of the request body, like
+//     "application/json". A content type like "image/*" matches any subtype.
+//
+// The first route that matches the request in every way is used. Overrides
+// for a route with a Host are set using the host followed by the template or
+// pattern, like "api.example.com/v1/users". See [ursa.Overrides.Set]
+//
+// Action tells what is done with the requests the route matches. By default
+// they are rate limited using Rates. With [ursa.AllowAction] they are sent
+// upstream without rate limiting, with [ursa.DenyAction] they are responded
+// with Status, [ursa.DefaultDenyStatus] by default, and with
+// [ursa.MaintenanceAction] they are responded with 503 Service Unavailable
+// and a Retry-After header telling clients to try again after RetryAfter,
+// [ursa.DefaultMaintenanceRetryAfter] by default. Both respond with a
+// [ursa.Problem] that has Body, if any, as its detail. Routes with an
+// action other than LimitAction don't need Rates.
+//
+// Anonymous tells what is done with requests that carry none of the values
+// the RateBys of the route look for. By default they are rejected, but they
+// can also be rate limited by IP or all together, or not be rate limited.
+// See [ursa.Anonymous]
+//
+// RejectionHandler, if set, responds to the requests to the route rejected
+// because their client ran out of tokens instead of RejectionHandler of
+// [ursa.Conf]
 type Route struct {
-	Methods []string
-	Pattern *regexp.Regexp // regex describing HTTP path to match
-	Rates   RouteRates
+	Methods   []string
+	Pattern   *regexp.Regexp // regex describing HTTP path to match
+	Template  string         // template describing HTTP path to match
+	Rates     RouteRates
+	PlanRates map[string]Rate
+	BucketBy  []string
+
+	Host        string
+	Headers     map[string]*regexp.Regexp
+	Query       map[string]*regexp.Regexp
+	ContentType string
+
+	Action     Action
+	Status     int
+	Body       string
+	RetryAfter time.Duration
+
+	Anonymous        Anonymous
+	RejectionHandler RejectionHandler
+}
+
+// Matched by every [ursa.ConfErrors] when checked using errors.Is
+var ErrInvalidConf = errors.New("invalid configuration")
+
+// A ConfError is a problem in a configuration found by [ursa.Validate]
+type ConfError struct {
+	Group string // Path of the group with the problem, like "Groups[1].Groups[0]", "" if none
+	Route int    // Index of the route in Routes of the group or the configuration, -1 if the problem isn't in a route
+	Field string // Name of the field with the problem, like "Rates"
+	Err   error
+}
+
+func (e *ConfError) Error() string {
+	var where string
+	if e.Group != "" {
+		where = e.Group + ": "
+	}
+	if e.Route >= 0 {
+		where += fmt.Sprintf("route %d: ", e.Route)
+	}
+	return fmt.Sprintf("%v%v: %v", where, e.Field, e.Err)
+}
+
+func (e *ConfError) Unwrap() error {
+	return e.Err
+}
+
+// ConfErrors are all the problems found in a configuration
+type ConfErrors []*ConfError
+
+func (errs ConfErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (errs ConfErrors) Is(target error) bool {
+	return target == ErrInvalidConf
+}
+
+// Checks the configuration and returns all the problems found in it, or nil
+// if it is valid.
+func Validate(conf Conf) ConfErrors {
+	var errs ConfErrors
+	addIn := func(group string, route int, field string, format string, args ...any) {
+		errs = append(errs, &ConfError{Group: group, Route: route, Field: field, Err: fmt.Errorf(format, args...)})
+	}
+	add := func(route int, field string, format string, args ...any) {
+		addIn("", route, field, format, args...)
+	}
+	if conf.Upstream == nil {
+		add(-1, "Upstream", "upstream url can't be nil")
+	} else if s := conf.Upstream.Scheme; s != "http" && s != "https" {
+		add(-1, "Upstream", "scheme of upstream url must be http or https, not %q", s)
+	} else if conf.Upstream.Host == "" {
+		add(-1, "Upstream", "upstream url has no host")
+	}
+	var validateGroups func(groups []RouteGroup, path string)
+	validateGroups = func(groups []RouteGroup, path string) {
+		for i, g := range groups {
+			group := groupPath(path, i)
+			if err := validatePrefix(g.Prefix); err != nil {
+				addIn(group, -1, "Prefix", "%v", err)
+			}
+			validateGroups(g.Groups, group)
+		}
+	}
+	validateGroups(conf.Groups, "")
+	routes := groupedRoutes(conf)
+	if conf.Routes == nil && len(conf.Groups) == 0 {
+		add(-1, "Routes", "routes cannot be nil")
+	} else if len(routes) == 0 {
+		add(-1, "Routes", "zero routes")
+	}
+	for _, gr := range routes {
+		r, i := gr.Route, gr.index
+		addRoute := func(field string, format string, args ...any) {
+			addIn(gr.group, i, field, format, args...)
+		}
+		if gr.err != nil {
+			addRoute("Pattern", "%v", gr.err)
+		}
+		if r.Template != "" {
+			pattern, err := templateRegexp(r.Template)
+			if err != nil {
+				addRoute("Template", "%v", err)
+			}
+			r.Pattern = pattern
+		} else if r.Pattern == nil {
+			addRoute("Pattern", "pattern is nil")
+		}
+		if n := conf.PathNormalization; n.FoldCase && !n.Raw && r.Pattern != nil {
+			if lit, ok := upperCaseLiteral(r.Pattern); ok {
+				field := "Pattern"
+				if r.Template != "" {
+					field = "Template"
+				}
+				addRoute(field, "%q has upper case letters but never matches them as FoldCase matches paths in lower case", lit)
+			}
+		}
+		validateAction(r, addRoute)
+		validateRates(r, addRoute)
+		validateAnonymous(r.Anonymous, addRoute)
+		for _, name := range r.BucketBy {
+			if r.Pattern != nil && r.Pattern.SubexpIndex(name) < 0 {
+				addRoute("BucketBy", "pattern has no capture group %q to bucket by", name)
+			}
+		}
+		if r.Methods == nil {
+			addRoute("Methods", "methods is nil")
+		} else if len(r.Methods) == 0 {
+			addRoute("Methods", "no methods defined")
+		} else if _, err := newMethodSet(r.Methods, conf.CustomMethods); err != nil {
+			addRoute("Methods", "%v", err)
+		}
+		if r.Host != "" {
+			if err := validateHost(r.Host); err != nil {
+				addRoute("Host", "%v", err)
+			}
+		}
+		if r.ContentType != "" {
+			if err := validateContentType(r.ContentType); err != nil {
+				addRoute("ContentType", "%v", err)
+			}
+		}
+	}
+	if fb := conf.Fallback; fb != nil {
+		if fb.Template != "" || fb.Pattern != nil || fb.Methods != nil || fb.BucketBy != nil ||
+			fb.Host != "" || fb.hasRequestConditions() {
+			add(-1, "Fallback", "fallback route can only have rates, an action and an anonymous policy")
+		}
+		addFallback := func(field string, format string, args ...any) {
+			add(-1, "Fallback."+field, format, args...)
+		}
+		validateAction(*fb, addFallback)
+		validateRates(*fb, addFallback)
+		validateAnonymous(fb.Anonymous, addFallback)
+	}
+	if ts := conf.PathNormalization.TrailingSlash; ts < KeepTrailingSlash || ts > AppendTrailingSlash {
+		add(-1, "PathNormalization", "invalid trailing slash policy %v", ts)
+	}
+	if conf.RateLimitHeaders.RetryAfterJitter < 0 {
+		add(-1, "RateLimitHeaders", "retry after jitter can't be negative, not %v", conf.RateLimitHeaders.RetryAfterJitter)
+	}
+	if mo := conf.MethodOverride; mo < StripMethodOverride || mo > RejectMethodOverride {
+		add(-1, "MethodOverride", "invalid method override policy %v", mo)
+	}
+	return errs
+}
+
+// Checks the rates of the route. Only routes with LimitAction need rates.
+func validateRates(r Route, add func(field string, format string, args ...any)) {
+	if r.Action == LimitAction && r.Rates == nil {
+		add("Rates", "rates is nil")
+	} else if r.Action == LimitAction && len(r.Rates) == 0 {
+		add("Rates", "no rates defined")
+	}
+	for by, rate := range r.Rates {
+		if by == nil {
+			add("Rates", "RateBy is nil")
+			continue
+		}
+		if err := validateRateBy(by); err != nil {
+			add("Rates", "RateBy %v: %v", by.source(), err)
+		}
+		if err := validateRate(rate); err != nil {
+			add("Rates", "rate for RateBy %v: %v", by.source(), err)
+		}
+	}
+	for _, plan := range sortedPlans(r.PlanRates) {
+		if err := validateRate(r.PlanRates[plan]); err != nil {
+			add("PlanRates", "rate for plan %q: %v", plan, err)
+		}
+	}
+}
+
+// Checks that the RateBy has what it needs to find signatures
+func validateRateBy(by *RateBy) error {
+	if by.Extractor != nil {
+		if by.Name == "" {
+			return errors.New("name is required when extractor is set")
+		}
+		return validateFailCode(by)
+	}
+	if by.Valid == nil && by.ValidateContext == nil {
+		return errors.New("valid function is nil")
+	}
+	if by.Signature == nil {
+		return errors.New("signature function is nil")
+	}
+	return validateFailCode(by)
+}
+
+// Checks that requests with an invalid value can be responded with FailCode
+func validateFailCode(by *RateBy) error {
+	if by.FailCode < 100 || by.FailCode > 599 {
+		return fmt.Errorf("invalid fail code %v", by.FailCode)
+	}
+	return nil
+}
+
+func validateRate(r Rate) error {
+	if r.Capacity <= 0 {
+		return fmt.Errorf("capacity must be positive, not %v", r.Capacity)
+	}
+	if r.RefillDurationInSec <= 0 {
+		return fmt.Errorf("refill duration must be positive, not %v", r.RefillDurationInSec)
+	}
+	return nil
+}
+
+// Returns the plans in order so that errors are reported in the same order
+// every time
+func sortedPlans(rates map[string]Rate) []string {
+	plans := make([]string, 0, len(rates))
+	for plan := range rates {
+		plans = append(plans, plan)
+	}
+	sort.Strings(plans)
+	return plans
 }
@@ -1,6 +1,8 @@
 package ursa
 
 import (
+	"errors"
+	"io"
 	"net/url"
 	"regexp"
 	"testing"
@@ -252,3 +254,141 @@ func TestConfInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestValidate(t *testing.T) {
+	valid := ValidConfSingleRoute
+	withRoute := func(change func(r *Route)) func() Conf {
+		return func() Conf {
+			conf := valid()
+			change(&conf.Routes[0])
+			return conf
+		}
+	}
+	type field struct {
+		route int
+		name  string
+	}
+	type test struct {
+		c           func() Conf
+		expErrors   []field
+		description string
+	}
+	tests := []test{
+		{c: valid, description: "valid"},
+		{c: NilConf, expErrors: []field{{-1, "Upstream"}, {-1, "Routes"}}, description: "NilConf"},
+		{
+			c:           InvalidConfBySecondRouteRates,
+			expErrors:   []field{{1, "Rates"}},
+			description: "InvalidConfBySecondRouteRates",
+		},
+		{
+			c: func() Conf {
+				conf := valid()
+				conf.Upstream, _ = url.Parse("ftp://example.com")
+				return conf
+			},
+			expErrors:   []field{{-1, "Upstream"}},
+			description: "upstream scheme",
+		},
+		{
+			c: func() Conf {
+				conf := valid()
+				conf.Upstream, _ = url.Parse("localhost:8000")
+				return conf
+			},
+			expErrors:   []field{{-1, "Upstream"}},
+			description: "upstream without scheme",
+		},
+		{
+			c:           withRoute(func(r *Route) { r.Rates = RouteRates{RateByIP: NewRate(0, Hour)} }),
+			expErrors:   []field{{0, "Rates"}},
+			description: "zero capacity",
+		},
+		{
+			c:           withRoute(func(r *Route) { r.Rates = RouteRates{RateByIP: NewRate(-5, Hour)} }),
+			expErrors:   []field{{0, "Rates"}},
+			description: "negative capacity",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.PlanRates = map[string]Rate{"pro": NewRate(0, Hour)}
+			}),
+			expErrors:   []field{{0, "PlanRates"}},
+			description: "zero capacity in plan",
+		},
+		{
+			c:           withRoute(func(r *Route) { r.Rates = RouteRates{nil: NewRate(5, Hour)} }),
+			expErrors:   []field{{0, "Rates"}},
+			description: "nil RateBy",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Rates = RouteRates{NewRateBy("User", nil, func(s string) string { return s }, 401, ""): NewRate(5, Hour)}
+			}),
+			expErrors:   []field{{0, "Rates"}},
+			description: "nil Valid",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Rates = RouteRates{NewRateBy("User", func(string) bool { return true }, nil, 401, ""): NewRate(5, Hour)}
+			}),
+			expErrors:   []field{{0, "Rates"}},
+			description: "nil Signature",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Rates = RouteRates{NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 0, ""): NewRate(5, Hour)}
+			}),
+			expErrors:   []field{{0, "Rates"}},
+			description: "RateBy without fail code",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Rates = RouteRates{NewRateByExtractor("user", pathParamExtractor{"id"}, 1000, ""): NewRate(5, Hour)}
+			}),
+			expErrors:   []field{{0, "Rates"}},
+			description: "RateBy with extractor and invalid fail code",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Rates = RouteRates{NewRateByPathParam("id"): NewRate(5, Hour)}
+			}),
+			description: "RateBy with extractor needs no Valid or Signature",
+		},
+		{
+			c: withRoute(func(r *Route) {
+				r.Methods = []string{"GETT"}
+				r.Host = "*"
+			}),
+			expErrors:   []field{{0, "Methods"}, {0, "Host"}},
+			description: "methods and host",
+		},
+	}
+	for _, test := range tests {
+		errs := Validate(test.c())
+		if len(errs) != len(test.expErrors) {
+			t.Errorf("case %v: expected %v errors got %v", test.description, len(test.expErrors), errs)
+			continue
+		}
+		for i, exp := range test.expErrors {
+			if errs[i].Route != exp.route || errs[i].Field != exp.name {
+				t.Errorf("case %v: expected error in route %v field %v got %v", test.description, exp.route, exp.name, errs[i])
+			}
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	if _, err := NewServer(NilConf()); !errors.Is(err, ErrInvalidConf) {
+		t.Errorf("expected ErrInvalidConf got %v", err)
+	}
+	var errs ConfErrors
+	if _, err := NewServer(InvalidConfBySecondRoutePattern()); !errors.As(err, &errs) || errs[0].Route != 1 {
+		t.Errorf("expected error in route 1 got %v", err)
+	}
+	conf := ValidConfSingleRoute()
+	conf.Logfile = io.Discard
+	if s, err := NewServer(conf); err != nil || s == nil {
+		t.Errorf("expected server got %v", err)
+	}
+}
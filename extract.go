@@ -0,0 +1,100 @@
+package ursa
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// An Extractor finds the identity (signature) of the downstream client that
+// sent the request. Unlike the Valid and Signature functions of
+// [ursa.RateBy] which only see a header value, an Extractor has access to the
+// full request, so it can consider the host, path, TLS state or any number
+// of headers when deciding who the client is.
+//
+// If the request doesn't carry what the Extractor looks for, it should return
+// an error wrapping [ursa.ErrNoValue] so that the remaining RateBys of the
+// route are tried. If the request carries an invalid credential it should
+// return an error wrapping [ursa.ErrInvalidValue] in which case the request is
+// responded with FailCode and FailMsg of the RateBy. An Extractor may also
+// return a *[ursa.ErrReqSignature] to respond with a status code and message
+// of its choice. Any other error means the Extractor failed to find out if
+// the request is valid, and the request is responded with
+// [ursa.ValidatorFailedHTTPCode].
+type Extractor interface {
+	Extract(ctx context.Context, r *http.Request) (string, error)
+}
+
+// The ExtractorFunc type is an adapter to allow the use of ordinary functions
+// as an [ursa.Extractor].
+type ExtractorFunc func(ctx context.Context, r *http.Request) (string, error)
+
+func (f ExtractorFunc) Extract(ctx context.Context, r *http.Request) (string, error) {
+	return f(ctx, r)
+}
+
+var (
+	// Returned by an Extractor when the request doesn't contain the value
+	// to perform rate limiting by.
+	ErrNoValue = errors.New("no value to rate limit by")
+	// Returned by an Extractor when the value to perform rate limiting by
+	// is present in the request but isn't valid.
+	ErrInvalidValue = errors.New("invalid value to rate limit by")
+)
+
+func (e *ErrReqSignature) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%d %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Code, http.StatusText(e.Code))
+}
+
+// Create a new RateBy that uses the given Extractor to find the signature of
+// the request.
+//
+// Params:
+// - name: unique name of the RateBy. It is used to tell apart signatures
+// created by different RateBys
+// - extractor: finds the signature from the request
+// - failCode: status code to respond if the extractor returns ErrInvalidValue
+// - failMsg: message to respond if the extractor returns ErrInvalidValue
+func NewRateByExtractor(name string, extractor Extractor, failCode int, failMsg string) *RateBy {
+	return &RateBy{
+		Name:      name,
+		Extractor: extractor,
+		FailCode:  failCode,
+		FailMsg:   failMsg,
+	}
+}
+
+// Extract makes every RateBy an [ursa.Extractor].
+//
+// If the Extractor field of the RateBy is set, it is used. Otherwise the value
+// is read from the request as described by Header, Cookie, Query and
+// BodyField, checked using ValidateContext or Valid and converted to
+// signature using Signature. If none of those fields are set, the IP address
+// of the client is used as the value, which is how [ursa.RateByIP] works.
+func (by *RateBy) Extract(ctx context.Context, r *http.Request) (string, error) {
+	if by.Extractor != nil {
+		return by.Extractor.Extract(ctx, r)
+	}
+	var val string
+	if by.source() == "" {
+		ip, err := clientIpAddr(r)
+		if err != nil {
+			return "", &ErrReqSignature{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+				Type:    ProblemInvalidClientIP,
+			}
+		}
+		val = ip
+	} else if val = by.valueFrom(r); val == "" {
+		return "", ErrNoValue
+	}
+	if err := by.validate(ctx, val); err != nil {
+		return "", err
+	}
+	return by.Signature(val), nil
+}
@@ -0,0 +1,78 @@
+package ursa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestGetReqSignatureExtractor(t *testing.T) {
+	// Extractor that limits by the host and a tenant header together
+	byTenant := NewRateByExtractor("tenant", ExtractorFunc(
+		func(_ context.Context, r *http.Request) (string, error) {
+			tenant := r.Header.Get("Tenant")
+			if tenant == "" {
+				return "", ErrNoValue
+			}
+			if tenant == "banned" {
+				return "", fmt.Errorf("tenant %v: %w", tenant, ErrInvalidValue)
+			}
+			if tenant == "teapot" {
+				return "", &ErrReqSignature{Code: http.StatusTeapot, Message: "teapot"}
+			}
+			return r.Host + "/" + tenant, nil
+		}), http.StatusForbidden, "Forbidden")
+
+	route := &Route{
+		Pattern: regexp.MustCompile("/"),
+		Rates:   RouteRates{byTenant: NewRate(10, Minute)},
+	}
+	type test struct {
+		tenant    string
+		expRateBy *RateBy
+		expReqSig reqSignature
+		expCode   int
+		expMsg    string
+	}
+	tests := []test{
+		{tenant: "", expCode: HeaderValueNotFoundInRequestForRateLimiting},
+		{tenant: "acme", expRateBy: byTenant, expReqSig: createReqSignature(byTenant, "example.com/acme")},
+		{tenant: "banned", expCode: http.StatusForbidden, expMsg: "Forbidden"},
+		{tenant: "teapot", expCode: http.StatusTeapot, expMsg: "teapot"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if test.tenant != "" {
+			r.Header.Set("Tenant", test.tenant)
+		}
+		gotRateBy, gotReqSig, gotErr := getReqSignature(r, route)
+		if gotRateBy != test.expRateBy {
+			t.Errorf("tenant %q: got rate by %v expected %v", test.tenant, gotRateBy, test.expRateBy)
+		}
+		if gotReqSig != test.expReqSig {
+			t.Errorf("tenant %q: got reqSig %v expected %v", test.tenant, gotReqSig, test.expReqSig)
+		}
+		if test.expCode == 0 && gotErr != nil {
+			t.Errorf("tenant %q: got unexpected error %v", test.tenant, gotErr)
+		}
+		if test.expCode != 0 {
+			if gotErr == nil {
+				t.Errorf("tenant %q: expected error with code %v", test.tenant, test.expCode)
+			} else if gotErr.Code != test.expCode || gotErr.Message != test.expMsg {
+				t.Errorf("tenant %q: got error %v expected %v %q", test.tenant, gotErr, test.expCode, test.expMsg)
+			}
+		}
+	}
+}
+
+func TestRateByIsExtractor(t *testing.T) {
+	var _ Extractor = RateByIP
+	r, _ := http.NewRequest("GET", "https://example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	sig, err := RateByIP.Extract(context.Background(), r)
+	if err != nil || sig != "10.0.0.1" {
+		t.Errorf("expected signature 10.0.0.1 got %q, error %v", sig, err)
+	}
+}
@@ -15,7 +15,8 @@ type gifter struct {
 	buckets   *linkedList[*bucket] // Buckets is a linked list of nodes. Each node holds *bucket.
 	rate      Rate
 	isRunning bool
-	ticker    time.Ticker
+	ticker    *time.Ticker
+	done      chan struct{} // Closed when the gifter is stopped
 	server    *server
 	sync.RWMutex
 }
@@ -34,26 +35,42 @@ func tickOnceEvery(r Rate) time.Duration {
 }
 
 func (g *gifter) start() {
+	ticker := time.NewTicker(tickOnceEvery(g.rate))
+	done := make(chan struct{})
 	g.Lock()
 	g.isRunning = true
+	g.ticker = ticker
+	g.done = done
 	g.Unlock()
-	ticker := time.NewTicker(tickOnceEvery(g.rate))
-	g.ticker = *ticker
-	// tickingCh := time.Tick(tickOnceEvery(g.rate))
 	go func() {
-		for g.isRunning {
-			<-ticker.C  // Block until a tick is received
-			go g.gift() // We run gift in a goroutine so that we get to next iteration of gift on time
+		for {
+			select {
+			case <-ticker.C: // Block until a tick is received
+				go g.gift() // We run gift in a goroutine so that we get to next iteration of gift on time
+			case <-done:
+				return
+			}
 		}
 	}()
 }
 
+// Stops gifting tokens. Buckets can't be added to a stopped gifter. Must be
+// called with the gifter locked.
+func (g *gifter) stop() {
+	if !g.isRunning {
+		return
+	}
+	g.isRunning = false
+	g.ticker.Stop()
+	close(g.done)
+}
+
 func (g *gifter) gift() {
 	// Goes through each node in the buckets linked list and gifts a token to
 	// each non-stale bucket that isn't full. It also deletes the node containing
 	// buckets that are stale
-	g.RLock()
-	defer g.RUnlock()
+	g.Lock()
+	defer g.Unlock()
 
 	// It should be safe to read to server's fields that are read only
 	staleDuration := g.server.bucketsStaleAfter
@@ -72,6 +89,7 @@ func (g *gifter) gift() {
 				g.server.logger.Info("removing stale bucket", "bucket", bucket.id)
 				// delete the bucket from the box
 				g.buckets.removeNode(n)
+				bucket.gifter, bucket.node = nil, nil
 				g.server.logger.Info("removed bucket from gifters chain", "bucket", bucket.id)
 				n.value.box.Lock()
 				delete(n.value.box.buckets, bucket.id)
@@ -83,17 +101,27 @@ func (g *gifter) gift() {
 	})
 }
 
-// Add a bucket to the linked list chain of gifters' buckets
-func (g *gifter) addBucket(b *bucket) {
-	g.RLock()
-	if g.buckets == nil {
-		g.RUnlock()
-		l := &linkedList[*bucket]{}
-		g.Lock()
-		g.buckets = l
+// Add a bucket to the linked list chain of gifters' buckets. Returns false if
+// the gifter has been stopped, in which case the bucket should be added to
+// the gifter that replaced it.
+func (g *gifter) addBucket(b *bucket) bool {
+	n := &node[*bucket]{value: b}
+	g.Lock()
+	if !g.isRunning {
 		g.Unlock()
+		return false
 	}
-	g.buckets.addNode(&node[*bucket]{value: b})
+	if g.buckets == nil {
+		g.buckets = &linkedList[*bucket]{}
+	}
+	g.buckets.addNode(n)
+	// The bucket remembers its node so that it can be moved to another
+	// gifter when its rate changes
+	b.Lock()
+	b.gifter, b.node = g, n
+	b.Unlock()
+	g.Unlock()
+	return true
 }
 
 // Generate gifter id based on rate
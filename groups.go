@@ -0,0 +1,185 @@
+package ursa
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// A RouteGroup holds routes that share a path prefix, methods or rates, so
+// that they don't need to be repeated in every route.
+//
+// Prefix is prepended to the Template or Pattern of the routes in the group.
+// It is a path like "/api/v1" and can have params like a template, as in
+// "/tenants/{tenant}", but no *. Patterns of routes in a group with a prefix
+// must start with ^ and have no other ^. The prefix is inserted right after
+// it, so that the pattern `^/users/(\d+)$` in the group "/api" becomes
+// `^/api(?:/users/(\d+)$)`, and `^/a|/b` becomes `^/api(?:/a|/b)`.
+//
+// Routes that have no Methods get the Methods of the group. Rates and
+// PlanRates of the group are added to those of the routes, a rate of the
+// route taking precedence over the rate of the group for the same RateBy or
+// plan.
+//
+// Groups can be nested, in which case the prefixes are joined and the
+// nested group inherits from its parent the same way routes do. The routes of
+// the nested groups come before the Routes of the group.
+type RouteGroup struct {
+	Prefix    string
+	Methods   []string
+	Rates     RouteRates
+	PlanRates map[string]Rate
+	Routes    []Route
+	Groups    []RouteGroup
+}
+
+// A route of a configuration with where it's defined
+type groupedRoute struct {
+	Route
+	group string // Path of the group, like "Groups[1].Groups[0]", "" if none
+	index int    // Index in Routes of the group or the configuration
+	err   error  // Problem with applying the group to the route
+}
+
+// Returns the routes of the configuration in the order they are matched. The
+// routes of Groups come first, followed by Routes.
+func groupedRoutes(conf Conf) []groupedRoute {
+	var routes []groupedRoute
+	var flatten func(g RouteGroup, path string)
+	flatten = func(g RouteGroup, path string) {
+		for i, sub := range g.Groups {
+			flatten(sub.inherit(g), groupPath(path, i))
+		}
+		for i, r := range g.Routes {
+			r, err := g.apply(r)
+			routes = append(routes, groupedRoute{r, path, i, err})
+		}
+	}
+	flatten(RouteGroup{Groups: conf.Groups}, "")
+	for i, r := range conf.Routes {
+		routes = append(routes, groupedRoute{Route: r, index: i})
+	}
+	return routes
+}
+
+// Returns the path of the group with the index in Groups of the group with
+// the path, "" being the configuration itself
+func groupPath(path string, i int) string {
+	if path == "" {
+		return fmt.Sprintf("Groups[%d]", i)
+	}
+	return fmt.Sprintf("%v.Groups[%d]", path, i)
+}
+
+// Returns the routes of the configuration with their groups applied, in the
+// order they are matched
+func flatRoutes(conf Conf) []Route {
+	grouped := groupedRoutes(conf)
+	routes := make([]Route, len(grouped))
+	for i, r := range grouped {
+		routes[i] = r.Route
+	}
+	return routes
+}
+
+// Returns the group with the defaults it inherits from its parent
+func (g RouteGroup) inherit(parent RouteGroup) RouteGroup {
+	if parent.Prefix != "" && g.Prefix != "" {
+		g.Prefix = strings.TrimSuffix(parent.Prefix, "/") + g.Prefix
+	} else if g.Prefix == "" {
+		g.Prefix = parent.Prefix
+	}
+	if g.Methods == nil {
+		g.Methods = parent.Methods
+	}
+	g.Rates = mergeDefaults(parent.Rates, g.Rates)
+	g.PlanRates = mergeDefaults(parent.PlanRates, g.PlanRates)
+	return g
+}
+
+// Returns the route with the prefix and the defaults of the group
+func (g RouteGroup) apply(r Route) (Route, error) {
+	if r.Methods == nil {
+		r.Methods = g.Methods
+	}
+	r.Rates = mergeDefaults(g.Rates, r.Rates)
+	r.PlanRates = mergeDefaults(g.PlanRates, r.PlanRates)
+	prefix := strings.TrimSuffix(g.Prefix, "/")
+	if prefix == "" {
+		return r, nil
+	}
+	if r.Template != "" {
+		r.Template = prefix + r.Template
+		return r, nil
+	}
+	if r.Pattern == nil {
+		return r, nil
+	}
+	rest, ok := strings.CutPrefix(r.Pattern.String(), "^")
+	if !ok {
+		return r, fmt.Errorf("pattern %q must start with ^ to be prefixed with %q", r.Pattern, g.Prefix)
+	}
+	if re, err := syntax.Parse(rest, syntax.Perl); err == nil && hasBeginAnchor(re) {
+		return r, fmt.Errorf("pattern %q can only have ^ at its start to be prefixed with %q", r.Pattern, g.Prefix)
+	}
+	prefixPattern, err := templateRegexp(prefix)
+	if err != nil {
+		return r, err
+	}
+	// The rest is grouped so that the prefix applies to all of its
+	// alternatives, as in ^/a|/b
+	pattern, err := regexp.Compile(strings.TrimSuffix(prefixPattern.String(), "$") + "(?:" + rest + ")")
+	if err != nil {
+		return r, err
+	}
+	r.Pattern = pattern
+	return r, nil
+}
+
+// Returns whether the regex has ^ or \A anywhere
+func hasBeginAnchor(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpBeginText || re.Op == syntax.OpBeginLine {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasBeginAnchor(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the entries of defaults and m, entries of m taking precedence
+func mergeDefaults[K comparable, V any](defaults, m map[K]V) map[K]V {
+	if len(defaults) == 0 {
+		return m
+	}
+	if len(m) == 0 {
+		return defaults
+	}
+	merged := make(map[K]V, len(defaults)+len(m))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range m {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Checks if Prefix of a group is valid
+func validatePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	segments, err := parseTemplate(prefix)
+	if err != nil {
+		return err
+	}
+	if segments[len(segments)-1] == "*" {
+		return errors.New("prefix can't end with *")
+	}
+	return nil
+}
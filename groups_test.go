@@ -0,0 +1,195 @@
+package ursa
+
+import (
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestFlatRoutes(t *testing.T) {
+	base, user := NewRate(10, Hour), NewRate(100, Hour)
+	byUser := NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 401, "")
+	conf := Conf{
+		Groups: []RouteGroup{
+			{
+				Prefix:  "/api/",
+				Methods: []string{"GET"},
+				Rates:   RouteRates{RateByIP: base, byUser: base},
+				Groups: []RouteGroup{
+					{
+						Prefix: "/tenants/{tenant}",
+						Rates:  RouteRates{byUser: user},
+						Routes: []Route{{Template: "/users"}},
+					},
+				},
+				Routes: []Route{
+					{Template: "/users/{id}"},
+					{Methods: []string{"POST"}, Pattern: regexp.MustCompile(`^/orders/(?P<id>\d+)$`), Rates: RouteRates{RateByIP: user}},
+				},
+			},
+		},
+		Routes: []Route{{Methods: []string{"GET"}, Pattern: regexp.MustCompile("^/"), Rates: RouteRates{RateByIP: base}}},
+	}
+	type expRoute struct {
+		methods []string
+		path    string // Template or Pattern
+		rates   RouteRates
+	}
+	exp := []expRoute{
+		{[]string{"GET"}, "/api/tenants/{tenant}/users", RouteRates{RateByIP: base, byUser: user}},
+		{[]string{"GET"}, "/api/users/{id}", RouteRates{RateByIP: base, byUser: base}},
+		{[]string{"POST"}, `^/api(?:/orders/(?P<id>\d+)$)`, RouteRates{RateByIP: user, byUser: base}},
+		{[]string{"GET"}, "^/", RouteRates{RateByIP: base}},
+	}
+	routes := flatRoutes(conf)
+	if len(routes) != len(exp) {
+		t.Fatalf("expected %v routes got %v", len(exp), len(routes))
+	}
+	for i, r := range routes {
+		path := r.Template
+		if path == "" {
+			path = r.Pattern.String()
+		}
+		if path != exp[i].path {
+			t.Errorf("route %d: expected path %v got %v", i, exp[i].path, path)
+		}
+		if !reflect.DeepEqual(r.Methods, exp[i].methods) {
+			t.Errorf("route %d: expected methods %v got %v", i, exp[i].methods, r.Methods)
+		}
+		if !reflect.DeepEqual(r.Rates, exp[i].rates) {
+			t.Errorf("route %d: expected rates %v got %v", i, exp[i].rates, r.Rates)
+		}
+	}
+	// Merging the rates doesn't change the rates of the group
+	if conf.Groups[0].Rates[byUser] != base {
+		t.Errorf("expected rates of the group to be unchanged")
+	}
+}
+
+func TestValidateGroups(t *testing.T) {
+	rates := RouteRates{RateByIP: NewRate(10, Hour)}
+	type test struct {
+		group       RouteGroup
+		expGroup    string
+		expRoute    int
+		expField    string
+		description string
+	}
+	tests := []test{
+		{
+			group:       RouteGroup{Prefix: "/api", Methods: []string{"GET"}, Rates: rates, Routes: []Route{{Pattern: regexp.MustCompile("/users")}}},
+			expGroup:    "Groups[0]",
+			expRoute:    0,
+			expField:    "Pattern",
+			description: "unanchored pattern in group with prefix",
+		},
+		{
+			group:       RouteGroup{Prefix: "/api", Methods: []string{"GET"}, Rates: rates, Routes: []Route{{Pattern: regexp.MustCompile("^/a$|^/b$")}}},
+			expGroup:    "Groups[0]",
+			expRoute:    0,
+			expField:    "Pattern",
+			description: "alternatives anchored with ^ in group with prefix",
+		},
+		{
+			group:       RouteGroup{Prefix: "/api/*", Methods: []string{"GET"}, Rates: rates, Routes: []Route{{Template: "/users"}}},
+			expGroup:    "Groups[0]",
+			expRoute:    -1,
+			expField:    "Prefix",
+			description: "prefix with *",
+		},
+		{
+			group:       RouteGroup{Methods: []string{"GET"}, Groups: []RouteGroup{{Routes: []Route{{Template: "/users"}}}}},
+			expGroup:    "Groups[0].Groups[0]",
+			expRoute:    0,
+			expField:    "Rates",
+			description: "no rates in route or groups",
+		},
+		{
+			group:       RouteGroup{Prefix: "/{id}", Rates: rates, Routes: []Route{{Methods: []string{"GET"}, Template: "/{id}"}}},
+			expGroup:    "Groups[0]",
+			expRoute:    0,
+			expField:    "Template",
+			description: "param in both prefix and template",
+		},
+	}
+	for _, test := range tests {
+		errs := Validate(Conf{Upstream: upstream(), Groups: []RouteGroup{test.group}})
+		if len(errs) == 0 {
+			t.Errorf("case %v: expected errors got none", test.description)
+			continue
+		}
+		if e := errs[0]; e.Group != test.expGroup || e.Route != test.expRoute || e.Field != test.expField {
+			t.Errorf("case %v: expected error in %v route %v field %v got %v", test.description, test.expGroup, test.expRoute, test.expField, e)
+		}
+	}
+}
+
+func TestRouteGroups(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Groups: []RouteGroup{{
+			Prefix:  "/api",
+			Methods: []string{"GET"},
+			Rates:   RouteRates{RateByIP: NewRate(1, Hour)},
+			Routes: []Route{
+				{Template: "/users"},
+				{Pattern: regexp.MustCompile(`^/orders/\d+$`), Rates: RouteRates{RateByIP: NewRate(2, Hour)}},
+			},
+		}},
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		method  string
+		url     string
+		expCode int
+	}
+	tests := []test{
+		{"GET", "/api/users", 200},
+		{"GET", "/api/users", 429},
+		// Not matched by any route as the group has the prefix
+		{"GET", "/users", 200},
+		{"GET", "/users", 200},
+		{"POST", "/api/users", 200},
+		{"GET", "/api/orders/1", 200},
+		{"GET", "/api/orders/2", 200},
+		{"GET", "/api/orders/3", 429},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if got := statusOf(s, r); got != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, got)
+		}
+	}
+}
+
+func TestGroupPatternAlternatives(t *testing.T) {
+	g := RouteGroup{Prefix: "/api"}
+	r, err := g.apply(Route{Pattern: regexp.MustCompile(`^/a$|/b$`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		path    string
+		matches bool
+	}
+	tests := []test{
+		{"/api/a", true},
+		{"/api/b", true},
+		{"/a", false},
+		{"/b", false},
+	}
+	for _, test := range tests {
+		if got := r.Pattern.MatchString(test.path); got != test.matches {
+			t.Errorf("%v: expected pattern %v to match %v got %v", test.path, r.Pattern, test.matches, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ursa
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitHeaders tells which headers telling clients about their limits are
+// added to the responses of rate limited routes.
+//
+// By default the RateLimit and RateLimit-Policy headers of the IETF draft
+// "RateLimit header fields for HTTP" are added, for example
+//
+//	RateLimit-Policy: "default";q=100;w=3600
+//	RateLimit: "default";r=42;t=1800
+//
+// which tell that the client is allowed 100 requests every hour, has 42 left
+// and gets its tokens back in 1800 seconds. Responses of rejected requests
+// also have a Retry-After header.
+type RateLimitHeaders struct {
+	// Omit leaves out the RateLimit and RateLimit-Policy headers
+	Omit bool
+	// Legacy adds the X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset headers used before the draft. X-RateLimit-Reset is
+	// the Unix time at which the tokens are given back.
+	Legacy bool
+	// RetryAfterJitter is the most time added at random to Retry-After, so
+	// that clients rejected at the same time don't all retry at once
+	RetryAfterJitter time.Duration
+}
+
+// Name of the quota policy in the RateLimit and RateLimit-Policy headers
+const rateLimitPolicyName = "default"
+
+// What the client is told about its bucket
+type bucketState struct {
+	rate      Rate
+	remaining int // Tokens left, never negative
+	reset     int // Seconds before the tokens are given back
+}
+
+// Returns the state of the bucket after a request. Must be called with the
+// bucket locked.
+func (b *bucket) state(now time.Time) bucketState {
+	st := bucketState{rate: *b.rate, remaining: max(b.tokens, 0)}
+	if b.tokens < 0 {
+		st.reset = max(secondsBeforeSuccess(now, b.lastGifted, b.rate, b.tokens), 0)
+	} else {
+		st.reset = secondsBeforeRefill(now, b.lastGifted, b.rate)
+	}
+	return st
+}
+
+// Returns the seconds before the bucket is next given tokens, assuming that
+// it's given tokens every tick since it was last given tokens
+func secondsBeforeRefill(now, lastGifted time.Time, r *Rate) int {
+	period := tickOnceEvery(*r)
+	elapsed := now.Sub(lastGifted) % period
+	return int(math.Ceil((period - elapsed).Seconds()))
+}
+
+// Adds the headers telling the client about its bucket to the response
+func (h RateLimitHeaders) set(header http.Header, st bucketState, now time.Time) {
+	if !h.Omit {
+		header.Set("RateLimit-Policy", fmt.Sprintf("%q;q=%d;w=%d", rateLimitPolicyName, st.rate.Capacity, st.rate.RefillDurationInSec))
+		header.Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", rateLimitPolicyName, st.remaining, st.reset))
+	}
+	if h.Legacy {
+		header.Set("X-RateLimit-Limit", strconv.Itoa(st.rate.Capacity))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(st.remaining))
+		reset := now.Add(time.Duration(st.reset) * time.Second)
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	}
+}
+
+// Returns the seconds the client is told to wait before retrying, which is
+// at least the seconds before the bucket has tokens again
+func (h RateLimitHeaders) retryAfter(st bucketState) int {
+	seconds := st.reset
+	if h.RetryAfterJitter > 0 {
+		jitter := time.Duration(rand.Int63n(int64(h.RetryAfterJitter) + 1))
+		seconds += int(math.Ceil(jitter.Seconds()))
+	}
+	return seconds
+}
@@ -0,0 +1,127 @@
+package ursa
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			{Methods: []string{"GET"}, Template: "/a", Rates: RouteRates{RateByIP: NewRate(2, Hour)}},
+			{Methods: []string{"GET"}, Template: "/health", Action: AllowAction},
+		},
+		RateLimitHeaders: RateLimitHeaders{Legacy: true, RetryAfterJitter: 10 * time.Second},
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		path         string
+		expCode      int
+		expPolicy    string
+		expRemaining string
+	}
+	tests := []test{
+		{path: "/a", expCode: 200, expPolicy: `"default";q=2;w=3600`, expRemaining: "1"},
+		{path: "/a", expCode: 200, expPolicy: `"default";q=2;w=3600`, expRemaining: "0"},
+		{path: "/a", expCode: 429, expPolicy: `"default";q=2;w=3600`, expRemaining: "0"},
+		{path: "/health", expCode: 200},
+	}
+	for i, test := range tests {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		h := rec.Header()
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+		if got := h.Get("RateLimit-Policy"); got != test.expPolicy {
+			t.Errorf("case %d: expected RateLimit-Policy %q got %q", i, test.expPolicy, got)
+		}
+		if got := h.Get("X-RateLimit-Remaining"); got != test.expRemaining {
+			t.Errorf("case %d: expected X-RateLimit-Remaining %q got %q", i, test.expRemaining, got)
+		}
+		if test.expPolicy == "" {
+			if h.Get("RateLimit") != "" || h.Get("X-RateLimit-Reset") != "" {
+				t.Errorf("case %d: expected no rate limit headers got %v", i, h)
+			}
+			continue
+		}
+		expPrefix := `"default";r=` + test.expRemaining + ";t="
+		limit := h.Get("RateLimit")
+		if len(limit) <= len(expPrefix) || limit[:len(expPrefix)] != expPrefix {
+			t.Errorf("case %d: expected RateLimit starting with %q got %q", i, expPrefix, limit)
+		}
+		reset, _ := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+		if reset < start.Unix() || reset > start.Add(time.Hour).Unix()+1 {
+			t.Errorf("case %d: expected X-RateLimit-Reset within an hour got %v", i, reset)
+		}
+		retryAfter := h.Get("Retry-After")
+		if test.expCode != 429 {
+			if retryAfter != "" {
+				t.Errorf("case %d: expected no Retry-After got %q", i, retryAfter)
+			}
+			continue
+		}
+		// An hour is needed to give back the tokens, plus up to 10 seconds
+		// of jitter
+		seconds, _ := strconv.Atoi(retryAfter)
+		if seconds < 3590 || seconds > 3611 {
+			t.Errorf("case %d: expected Retry-After of about 3600 got %q", i, retryAfter)
+		}
+	}
+}
+
+func TestOmitRateLimitHeaders(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	conf := Conf{
+		Upstream:         upstream,
+		Logfile:          io.Discard,
+		Routes:           []Route{{Methods: []string{"GET"}, Template: "/a", Rates: RouteRates{RateByIP: NewRate(1, Hour)}}},
+		RateLimitHeaders: RateLimitHeaders{Omit: true},
+	}
+	s := New(conf)
+	for i, expCode := range []int{200, 429} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/a", nil))
+		h := rec.Header()
+		if rec.Code != expCode || h.Get("RateLimit") != "" || h.Get("X-RateLimit-Limit") != "" {
+			t.Errorf("case %d: expected code %v without rate limit headers got %v %v", i, expCode, rec.Code, h)
+		}
+		if expCode == 429 && h.Get("Retry-After") == "" {
+			t.Errorf("case %d: expected Retry-After even when headers are omitted", i)
+		}
+	}
+}
+
+func TestSecondsBeforeRefill(t *testing.T) {
+	rate := NewRate(10, Minute)
+	lastGifted := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type test struct {
+		now      time.Time
+		expected int
+	}
+	tests := []test{
+		{lastGifted, 60},
+		{lastGifted.Add(10 * time.Second), 50},
+		{lastGifted.Add(59500 * time.Millisecond), 1},
+		{lastGifted.Add(3*time.Minute + 15*time.Second), 45},
+	}
+	for i, test := range tests {
+		if got := secondsBeforeRefill(test.now, lastGifted, &rate); got != test.expected {
+			t.Errorf("case %d: expected %v got %v", i, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package ursa
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authorization scheme of requests signed as described in [ursa.SignRequest]
+const HMACScheme = "URSA-HMAC-SHA256"
+
+// Header field holding the time at which a request was signed, in the
+// format of [ursa.HMACTimeFormat]
+const HMACDateHeader = "X-Ursa-Date"
+
+// Format of the time in [ursa.HMACDateHeader]
+const HMACTimeFormat = "20060102T150405Z"
+
+// Default window within which the time a request was signed must be
+const DefaultHMACSkew = 5 * time.Minute
+
+// Configuration to provide when creating a RateBy using [ursa.NewRateByHMAC]
+//
+// Keys maps access key ids to their secrets. See [ursa.LoadHMACKeys]. There
+// must be at least one key and no secret can be empty, as anyone can sign
+// requests with an empty secret.
+//
+// Skew is the maximum difference allowed between the time a request was
+// signed and the time it is received. It defaults to [ursa.DefaultHMACSkew].
+// A signature is only accepted once within this window to protect against
+// replaying captured requests.
+//
+// MaxBodyBytes is the maximum size of body of the requests that can be
+// verified. It defaults to [ursa.DefaultMaxBodyBytes].
+//
+// FailCode and FailMsg are used to respond to requests with an invalid
+// signature. FailCode defaults to 401 Unauthorized.
+type HMACConf struct {
+	Keys         map[string][]byte
+	Skew         time.Duration
+	MaxBodyBytes int64
+	FailCode     int
+	FailMsg      string
+}
+
+type hmacVerifier struct {
+	keys         map[string][]byte
+	skew         time.Duration
+	maxBodyBytes int64
+	seen         map[string]time.Time // Maps signatures seen to when they can be forgotten
+	lastSweep    time.Time
+	mu           sync.Mutex
+}
+
+// Create a RateBy for requests signed with a secret shared between the client
+// and ursa as described in [ursa.SignRequest]. The access key id is used as
+// the signature, so only requests with a valid signature reach the bucket of
+// the client. Requests with an invalid, stale or replayed signature are
+// responded with FailCode and FailMsg. Requests without the Authorization
+// header of the [ursa.HMACScheme] are left to the other RateBys of the route.
+func NewRateByHMAC(conf HMACConf) (*RateBy, error) {
+	if err := validateHMACKeys(conf.Keys); err != nil {
+		return nil, err
+	}
+	v := &hmacVerifier{
+		keys:         conf.Keys,
+		skew:         conf.Skew,
+		maxBodyBytes: conf.MaxBodyBytes,
+		seen:         make(map[string]time.Time),
+	}
+	if v.skew <= 0 {
+		v.skew = DefaultHMACSkew
+	}
+	failCode := conf.FailCode
+	if failCode == 0 {
+		failCode = http.StatusUnauthorized
+	}
+	return NewRateByExtractor("hmac", v, failCode, conf.FailMsg), nil
+}
+
+func validateHMACKeys(keys map[string][]byte) error {
+	if len(keys) == 0 {
+		return errors.New("hmac: no keys to verify signatures with")
+	}
+	for id, secret := range keys {
+		if len(secret) == 0 {
+			return fmt.Errorf("hmac: empty secret for key %q", id)
+		}
+	}
+	return nil
+}
+
+// Load HMAC keys from a JSON file that maps access key ids to secrets as in
+//
+//	{"keys": {"client-1": "secret-1", "client-2": "secret-2"}}
+func LoadHMACKeys(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	keys := make(map[string][]byte)
+	for id, secret := range file.Keys {
+		keys[id] = []byte(secret)
+	}
+	if err := validateHMACKeys(keys); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return keys, nil
+}
+
+// Sign the request with the given access key id and secret, at the given time.
+// This is what clients of a route rate limited by [ursa.NewRateByHMAC] need to
+// do. The signature is the hex encoded HMAC-SHA256 of the string
+//
+//	METHOD + "\n" + escaped path + "\n" + raw query + "\n" + time + "\n" + hex(sha256(body))
+//
+// where time is formatted as [ursa.HMACTimeFormat] in UTC and the path is the
+// one the request is sent with, before ursa normalizes it. It is sent in the
+// Authorization header as
+//
+//	URSA-HMAC-SHA256 Credential=<access key id>, Signature=<signature>
+//
+// along with the time in [ursa.HMACDateHeader] header. The body of the request
+// is read and put back in place.
+func SignRequest(r *http.Request, keyID string, secret []byte, t time.Time) error {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	date := t.UTC().Format(HMACTimeFormat)
+	sig := hmacSignature(r, date, body, secret)
+	r.Header.Set(HMACDateHeader, date)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Signature=%s", HMACScheme, keyID, sig))
+	return nil
+}
+
+func hmacSignature(r *http.Request, date string, body []byte, secret []byte) string {
+	bodyHash := sha256.Sum256(body)
+	toSign := strings.Join([]string{
+		r.Method,
+		signedPath(r),
+		r.URL.RawQuery,
+		date,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(toSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the path of the request as the client sent it. Requests received
+// by a server keep it in RequestURI even after ursa normalizes their URL,
+// while requests being sent have no RequestURI.
+func signedPath(r *http.Request) string {
+	if r.RequestURI == "" {
+		return r.URL.EscapedPath()
+	}
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		return r.URL.EscapedPath()
+	}
+	return u.EscapedPath()
+}
+
+func (v *hmacVerifier) Extract(_ context.Context, r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	scheme, params, _ := strings.Cut(auth, " ")
+	if scheme != HMACScheme {
+		return "", ErrNoValue
+	}
+	var keyID, sig string
+	for _, p := range strings.Split(params, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch name {
+		case "Credential":
+			keyID = val
+		case "Signature":
+			sig = val
+		}
+	}
+	secret, ok := v.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("hmac: unknown access key %q: %w", keyID, ErrInvalidValue)
+	}
+	date := r.Header.Get(HMACDateHeader)
+	signedAt, err := time.Parse(HMACTimeFormat, date)
+	if err != nil {
+		return "", fmt.Errorf("hmac: invalid date: %w", ErrInvalidValue)
+	}
+	now := time.Now()
+	if signedAt.Before(now.Add(-v.skew)) || signedAt.After(now.Add(v.skew)) {
+		return "", fmt.Errorf("hmac: request signed at %v is outside allowed window: %w", date, ErrInvalidValue)
+	}
+	body, ok := peekBody(r, v.maxBodyBytes)
+	if !ok {
+		return "", fmt.Errorf("hmac: body too large to verify: %w", ErrInvalidValue)
+	}
+	expected := hmacSignature(r, date, body, secret)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(sig))) {
+		return "", fmt.Errorf("hmac: invalid signature: %w", ErrInvalidValue)
+	}
+	if !v.firstUse(expected, signedAt, now) {
+		return "", fmt.Errorf("hmac: replayed signature: %w", ErrInvalidValue)
+	}
+	return keyID, nil
+}
+
+// Records that the signature was used and returns false if it had been used
+// before. A signature only needs to be remembered until the time it was
+// signed at falls out of the skew window, after which it is rejected anyway.
+func (v *hmacVerifier) firstUse(sig string, signedAt, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.lastSweep) > v.skew {
+		for s, forgetAt := range v.seen {
+			if now.After(forgetAt) {
+				delete(v.seen, s)
+			}
+		}
+		v.lastSweep = now
+	}
+	if _, ok := v.seen[sig]; ok {
+		return false
+	}
+	v.seen[sig] = signedAt.Add(v.skew)
+	return true
+}
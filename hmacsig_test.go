@@ -0,0 +1,142 @@
+package ursa
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACRateBy(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(keysFile, []byte(`{"keys": {"client-1": "secret-1"}}`), 0o600)
+	keys, err := LoadHMACKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	by, err := NewRateByHMAC(HMACConf{Keys: keys, Skew: time.Minute, MaxBodyBytes: 100, FailCode: 401})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRequest := func(body string) *http.Request {
+		r, _ := http.NewRequest("POST", "https://example.com/orders?page=2", strings.NewReader(body))
+		return r
+	}
+	signed := func(body, keyID, secret string, at time.Time) *http.Request {
+		r := newRequest(body)
+		if err := SignRequest(r, keyID, []byte(secret), at); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	now := time.Now()
+	replayed := signed(`{"n": 2}`, "client-1", "secret-1", now)
+	tampered := signed(`{"n": 1}`, "client-1", "secret-1", now)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"n": 1000}`))
+	otherPath := signed(`{"n": 1}`, "client-1", "secret-1", now)
+	otherPath.URL.Path = "/admin"
+
+	type test struct {
+		req    *http.Request
+		expSig string
+		expErr error
+	}
+	tests := []test{
+		{req: newRequest(""), expErr: ErrNoValue},
+		{req: signed(`{"n": 1}`, "client-1", "secret-1", now), expSig: "client-1"},
+		{req: signed("", "client-1", "secret-1", now.Add(-30*time.Second)), expSig: "client-1"},
+		{req: replayed, expSig: "client-1"},
+		{req: replayed, expErr: ErrInvalidValue},
+		{req: tampered, expErr: ErrInvalidValue},
+		{req: otherPath, expErr: ErrInvalidValue},
+		{req: signed(`{}`, "client-1", "wrong-secret", now), expErr: ErrInvalidValue},
+		{req: signed(`{}`, "client-2", "secret-1", now), expErr: ErrInvalidValue},
+		{req: signed(`{}`, "client-1", "secret-1", now.Add(-2*time.Minute)), expErr: ErrInvalidValue},
+		{req: signed(`{}`, "client-1", "secret-1", now.Add(2*time.Minute)), expErr: ErrInvalidValue},
+		{req: signed(strings.Repeat("a", 101), "client-1", "secret-1", now), expErr: ErrInvalidValue},
+	}
+	for i, test := range tests {
+		sig, err := by.Extract(context.Background(), test.req)
+		if !errors.Is(err, test.expErr) || (test.expErr == nil && err != nil) {
+			t.Errorf("case %d: expected error %v got %v", i, test.expErr, err)
+		}
+		if sig != test.expSig {
+			t.Errorf("case %d: expected signature %q got %q", i, test.expSig, sig)
+		}
+	}
+
+	// Body is left intact to be proxied
+	r := signed(`{"n": 3}`, "client-1", "secret-1", now)
+	by.Extract(context.Background(), r)
+	if b, _ := io.ReadAll(r.Body); string(b) != `{"n": 3}` {
+		t.Errorf("expected body to be intact, got %q", b)
+	}
+
+	if by, _ := NewRateByHMAC(HMACConf{Keys: keys}); by.FailCode != 401 {
+		t.Errorf("expected fail code to default to 401 got %v", by.FailCode)
+	}
+}
+
+func TestHMACKeys(t *testing.T) {
+	type test struct {
+		file   string
+		expErr bool
+	}
+	tests := []test{
+		{`{"keys": {"client-1": "secret-1"}}`, false},
+		{`{"keys": {"client-1": "secret-1", "client-2": ""}}`, true},
+		{`{"keys": {}}`, true},
+		{`{}`, true},
+	}
+	for i, test := range tests {
+		keysFile := filepath.Join(t.TempDir(), "keys.json")
+		os.WriteFile(keysFile, []byte(test.file), 0o600)
+		if _, err := LoadHMACKeys(keysFile); (err != nil) != test.expErr {
+			t.Errorf("case %d: expected error %v got %v", i, test.expErr, err)
+		}
+	}
+	for i, keys := range []map[string][]byte{nil, {"client-1": nil}} {
+		if _, err := NewRateByHMAC(HMACConf{Keys: keys}); err == nil {
+			t.Errorf("case %d: expected an error for keys %v", i, keys)
+		}
+	}
+}
+
+func TestHMACWithNormalizedPath(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+	keys := map[string][]byte{"client-1": []byte("secret-1")}
+	by, err := NewRateByHMAC(HMACConf{Keys: keys, Skew: time.Minute, FailCode: 401})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{{
+			Methods: []string{"GET"},
+			Pattern: regexp.MustCompile("^/orders"),
+			Rates:   RouteRates{by: NewRate(10, Hour)},
+		}},
+		PathNormalization: PathNormalization{TrailingSlash: AppendTrailingSlash},
+	})
+	// The signature covers the path the client sent, not the normalized
+	// one sent upstream
+	for _, path := range []string{"/orders", "/orders//1", "/orders/./2"} {
+		r := httptest.NewRequest("GET", path, nil)
+		if err := SignRequest(r, "client-1", []byte("secret-1"), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if got := statusOf(s, r); got != 200 {
+			t.Errorf("%v: expected 200 got %v", path, got)
+		}
+	}
+}
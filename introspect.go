@@ -0,0 +1,186 @@
+package ursa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ursaserver/ursa/memoize"
+)
+
+// Default duration for which inactive tokens are remembered when rate limiting
+// by OAuth2 token introspection
+const DefaultInactiveTokenTTL = time.Minute
+
+// Configuration to provide when creating a RateBy using
+// [ursa.NewRateByIntrospection]
+//
+// Endpoint is the URL of the RFC 7662 introspection endpoint of the
+// authorization server. ClientID and ClientSecret, if set, are used to
+// authenticate to the endpoint with HTTP basic authentication. Client is the
+// HTTP client used to call the endpoint and defaults to a client with a 10
+// second timeout.
+//
+// Header is the header field that holds the bearer token. It defaults to
+// Authorization. Values with a scheme other than Bearer, like "Basic ...",
+// are left to the other RateBys of the route without calling the endpoint.
+//
+// Name is the name of the RateBy, which tells apart the signatures and
+// overrides of different RateBys. It defaults to "introspection:" followed by
+// Header and Claim, like "introspection:Authorization:sub". Set it when two
+// RateBys read the same claim from the same header, for example with
+// different endpoints.
+//
+// Claim is the field of the introspection response used as the signature,
+// usually "sub" or "client_id". It defaults to "sub".
+//
+// Active tokens are remembered until their exp, but for at most MaxTTL if it
+// is set. Active tokens without exp are only remembered if MaxTTL is set.
+// Inactive tokens are remembered for InactiveTTL which defaults to
+// [ursa.DefaultInactiveTokenTTL]. Failures in calling the endpoint are never
+// remembered.
+//
+// FailCode and FailMsg are used to respond to requests with an inactive token.
+// FailCode defaults to 401 Unauthorized.
+type IntrospectionConf struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client
+	Header       string
+	Name         string
+	Claim        string
+	MaxTTL       time.Duration
+	InactiveTTL  time.Duration
+	FailCode     int
+	FailMsg      string
+}
+
+// Response of an introspection endpoint as described in RFC 7662
+type introspection struct {
+	active bool
+	exp    int64          // Unix time at which the token expires, 0 if unknown
+	claims map[string]any // All the fields in the response
+}
+
+type introspector struct {
+	conf       IntrospectionConf
+	introspect func(context.Context, string) (introspection, error)
+}
+
+// Create a RateBy that resolves opaque OAuth2 bearer tokens by calling the
+// introspection endpoint of the authorization server, and performs rate
+// limiting by the subject or client of active tokens. Results are cached so
+// that the endpoint is called once per token rather than once per request.
+// Requests with inactive tokens are responded with FailCode and FailMsg. If
+// the endpoint can't be reached, requests are responded with
+// [ursa.ValidatorFailedHTTPCode].
+func NewRateByIntrospection(conf IntrospectionConf) (*RateBy, error) {
+	if _, err := url.ParseRequestURI(conf.Endpoint); err != nil {
+		return nil, fmt.Errorf("introspection endpoint: %w", err)
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if conf.Header == "" {
+		conf.Header = "Authorization"
+	}
+	if conf.Claim == "" {
+		conf.Claim = "sub"
+	}
+	if conf.InactiveTTL == 0 {
+		conf.InactiveTTL = DefaultInactiveTokenTTL
+	}
+	if conf.FailCode == 0 {
+		conf.FailCode = http.StatusUnauthorized
+	}
+	i := &introspector{conf: conf}
+	i.introspect = memoize.Expiring(i.call, i.ttl)
+	name := conf.Name
+	if name == "" {
+		name = "introspection:" + conf.Header + ":" + conf.Claim
+	}
+	return NewRateByExtractor(name, i, conf.FailCode, conf.FailMsg), nil
+}
+
+func (i *introspector) Extract(ctx context.Context, r *http.Request) (string, error) {
+	token, ok := bearerToken(r.Header.Get(i.conf.Header))
+	if !ok || token == "" {
+		return "", ErrNoValue
+	}
+	result, err := i.introspect(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	// A cached result may outlive the token if the clock of the
+	// authorization server is ahead of ours
+	if !result.active || (result.exp != 0 && time.Now().Unix() >= result.exp) {
+		return "", fmt.Errorf("introspection: token inactive: %w", ErrInvalidValue)
+	}
+	sig, ok := claimString(result.claims[i.conf.Claim])
+	if !ok || sig == "" {
+		return "", fmt.Errorf("introspection: %v missing: %w", i.conf.Claim, ErrInvalidValue)
+	}
+	return sig, nil
+}
+
+// Calls the introspection endpoint for the token
+func (i *introspector) call(ctx context.Context, token string) (introspection, error) {
+	var result introspection
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.conf.Endpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.conf.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.conf.ClientID), url.QueryEscape(i.conf.ClientSecret))
+	}
+	rsp, err := i.conf.Client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("introspection endpoint responded with %v", rsp.Status)
+	}
+	dec := json.NewDecoder(rsp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&result.claims); err != nil {
+		return result, fmt.Errorf("decoding introspection response: %w", err)
+	}
+	active, ok := result.claims["active"].(bool)
+	if !ok {
+		return result, errors.New("introspection response has no active field")
+	}
+	result.active = active
+	if exp, ok := claimTime(result.claims["exp"]); ok {
+		result.exp = exp.Unix()
+	}
+	return result, nil
+}
+
+// Returns how long the result of introspection should be cached
+func (i *introspector) ttl(result introspection, err error) time.Duration {
+	if err != nil {
+		return 0
+	}
+	if !result.active {
+		return i.conf.InactiveTTL
+	}
+	ttl := i.conf.MaxTTL
+	if result.exp != 0 {
+		untilExp := time.Until(time.Unix(result.exp, 0))
+		if ttl <= 0 || untilExp < ttl {
+			ttl = untilExp
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,116 @@
+package ursa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntrospectionRateBy(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	exp := time.Now().Add(time.Hour).Unix()
+	tokens := map[string]map[string]any{
+		"user-token":   {"active": true, "sub": "user-1", "client_id": "app-1", "exp": exp},
+		"client-token": {"active": true, "client_id": "app-2", "exp": exp},
+		"old-token":    {"active": true, "sub": "user-2", "exp": time.Now().Add(-time.Minute).Unix()},
+	}
+	// A stand-in for the introspection endpoint of an authorization server
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if id, secret, ok := r.BasicAuth(); !ok || id != "ursa" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rsp, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			rsp = map[string]any{"active": false}
+		}
+		json.NewEncoder(w).Encode(rsp)
+	}))
+	defer srv.Close()
+
+	conf := IntrospectionConf{
+		Endpoint:     srv.URL,
+		ClientID:     "ursa",
+		ClientSecret: "s3cret",
+	}
+	bySub, err := NewRateByIntrospection(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Claim = "client_id"
+	byClient, _ := NewRateByIntrospection(conf)
+	if bySub.Name != "introspection:Authorization:sub" || byClient.Name != "introspection:Authorization:client_id" {
+		t.Errorf("expected names telling the header and claim got %v and %v", bySub.Name, byClient.Name)
+	}
+	conf.Name = "partner"
+	if named, _ := NewRateByIntrospection(conf); named.Name != "partner" {
+		t.Errorf("expected the name of the configuration got %v", named.Name)
+	}
+	if bySub.FailCode != http.StatusUnauthorized {
+		t.Errorf("expected fail code to default to 401 got %v", bySub.FailCode)
+	}
+
+	type test struct {
+		by       *RateBy
+		token    string
+		auth     string // Authorization header to send instead of the token
+		down     bool
+		expSig   string
+		expErr   error
+		expCalls int32
+	}
+	tests := []test{
+		{by: bySub, token: "", expErr: ErrNoValue, expCalls: 0},
+		// Other schemes are left to other RateBys without calling the endpoint
+		{by: bySub, auth: "Basic dXNlcjpwYXNz", expErr: ErrNoValue, expCalls: 0},
+		{by: bySub, token: "user-token", expSig: "user-1", expCalls: 1},
+		// Active tokens are cached until they expire
+		{by: bySub, token: "user-token", expSig: "user-1", expCalls: 1},
+		{by: bySub, token: "client-token", expErr: ErrInvalidValue, expCalls: 2},
+		{by: byClient, token: "client-token", expSig: "app-2", expCalls: 3},
+		{by: bySub, token: "unknown-token", expErr: ErrInvalidValue, expCalls: 4},
+		// Inactive tokens are cached too
+		{by: bySub, token: "unknown-token", expErr: ErrInvalidValue, expCalls: 4},
+		{by: bySub, token: "old-token", expErr: ErrInvalidValue, expCalls: 5},
+		// Endpoint failures aren't mistaken for inactive tokens nor cached
+		{by: bySub, token: "other-token", down: true, expCalls: 6},
+		{by: bySub, token: "other-token", down: true, expCalls: 7},
+		{by: bySub, token: "user-token", down: true, expSig: "user-1", expCalls: 7},
+	}
+	for i, test := range tests {
+		down.Store(test.down)
+		r, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		sig, err := test.by.Extract(context.Background(), r)
+		switch {
+		case test.down && test.expSig == "":
+			if err == nil || errors.Is(err, ErrInvalidValue) || errors.Is(err, ErrNoValue) {
+				t.Errorf("case %d: expected endpoint failure got %v", i, err)
+			}
+		case !errors.Is(err, test.expErr) || (test.expErr == nil && err != nil):
+			t.Errorf("case %d: expected error %v got %v", i, test.expErr, err)
+		}
+		if sig != test.expSig {
+			t.Errorf("case %d: expected signature %q got %q", i, test.expSig, sig)
+		}
+		if c := calls.Load(); c != test.expCalls {
+			t.Errorf("case %d: expected %v calls to endpoint got %v", i, test.expCalls, c)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build ignore
+
+// Writes the JSON Schema of configuration files to schema.json
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ursaserver/ursa/jsonconf"
+)
+
+func main() {
+	schema, err := jsonconf.Schema()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("schema.json", append(schema, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,666 @@
+// Package jsonconf builds a [ursa.Conf] from a JSON document, so that a rate
+// limiter can be configured without writing Go code.
+//
+// Rates and RateBys are defined once by name and routes refer to them by
+// name:
+//
+//	{
+//		"$schema": "https://raw.githubusercontent.com/ursaserver/ursa/main/jsonconf/schema.json",
+//		"upstream": "http://localhost:8000",
+//		"rates": {
+//			"anonymous": {"capacity": 5, "per": "minute"},
+//			"user": {"capacity": 60, "per": "minute"}
+//		},
+//		"rateBys": {
+//			"user": {"type": "jwt", "keys": "jwks.json", "claim": "sub"}
+//		},
+//		"routes": [
+//			{
+//				"methods": ["GET"],
+//				"template": "/products/{id}",
+//				"rates": {"ip": "anonymous", "user": "user"}
+//			}
+//		]
+//	}
+//
+// The RateBy named "ip" is always defined and is [ursa.RateByIP].
+//
+// A file can include other files, whose rates, RateBys, plans and routes are
+// added to the configuration. The routes of included files come before those
+// of the including file, in the order the files are included. Paths of
+// included files, and of other files like keys, are relative to the file
+// they appear in.
+//
+// The JSON Schema of the document is in schema.json, which editors can use
+// to validate and complete configuration files. See [Schema]
+package jsonconf
+
+//go:generate go run gen_schema.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ursaserver/ursa"
+)
+
+// The document as it is written in a file
+type file struct {
+	Schema            string             `json:"$schema,omitempty" doc:"URL of the JSON Schema of the file"`
+	Include           []string           `json:"include,omitempty" doc:"Files whose rates, rateBys, plans, groups and routes are added to the configuration"`
+	Upstream          string             `json:"upstream,omitempty" doc:"URL of the server requests are proxied to. Required in the main file"`
+	Logfile           string             `json:"logfile,omitempty" doc:"File to write logs to. Defaults to standard output"`
+	RouteCacheSize    int                `json:"routeCacheSize,omitempty" doc:"Number of matched routes to remember"`
+	PathNormalization *pathNormalization `json:"pathNormalization,omitempty" doc:"How paths are normalized before they are matched to routes"`
+	MethodOverride    string             `json:"methodOverride,omitempty" doc:"What to do with method override headers" enum:"strip,apply,reject"`
+	CustomMethods     []string           `json:"customMethods,omitempty" doc:"Methods other than the standard HTTP methods that routes can use"`
+	Overrides         string             `json:"overrides,omitempty" doc:"File to keep the rate overrides of clients in"`
+	Plans             map[string]string  `json:"plans,omitempty" doc:"Maps signatures of clients to their plans"`
+	Rates             map[string]rate    `json:"rates,omitempty" doc:"Rates by name"`
+	RateBys           map[string]rateBy  `json:"rateBys,omitempty" doc:"RateBys by name. The RateBy named ip is always defined"`
+	Groups            []group            `json:"groups,omitempty" doc:"Groups of routes sharing a path prefix, methods or rates. Their routes are matched before routes"`
+	Routes            []route            `json:"routes,omitempty" doc:"Routes in the order they are matched"`
+	RateLimitHeaders  *rateLimitHeaders  `json:"rateLimitHeaders,omitempty" doc:"Which headers tell clients about their limits"`
+	Fallback          *policy            `json:"fallback,omitempty" doc:"Rates and action for requests that match no route. Such requests are sent upstream without rate limiting by default"`
+}
+
+type pathNormalization struct {
+	Raw           bool   `json:"raw,omitempty" doc:"Match paths exactly as they are in the request"`
+	TrailingSlash string `json:"trailingSlash,omitempty" doc:"How a trailing slash is treated" enum:"keep,strip,append"`
+	FoldCase      bool   `json:"foldCase,omitempty" doc:"Match paths in lower case"`
+}
+
+type rateLimitHeaders struct {
+	Omit             bool   `json:"omit,omitempty" doc:"Leave out the RateLimit and RateLimit-Policy headers"`
+	Legacy           bool   `json:"legacy,omitempty" doc:"Add the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers"`
+	RetryAfterJitter string `json:"retryAfterJitter,omitempty" doc:"Most time added at random to Retry-After, like 5s"`
+}
+
+type rate struct {
+	Capacity int    `json:"capacity" doc:"Number of requests allowed" required:"true"`
+	Per      string `json:"per" doc:"Duration in which capacity requests are allowed" enum:"minute,hour,day" required:"true"`
+}
+
+type rateBy struct {
+	Type         string   `json:"type" doc:"Kind of RateBy" enum:"header,cookie,query,body,jwt,apiKey,clientCert,hmac,introspection,pathParam" required:"true"`
+	Header       string   `json:"header,omitempty" doc:"Header holding the value, for header, jwt, apiKey and introspection. Defaults to X-API-Key for apiKey and Authorization for jwt and introspection"`
+	Cookie       string   `json:"cookie,omitempty" doc:"Cookie holding the value, for cookie"`
+	Query        string   `json:"query,omitempty" doc:"Query parameter holding the value, for query"`
+	Field        string   `json:"field,omitempty" doc:"Field of the JSON body holding the value, like user.id, for body"`
+	Param        string   `json:"param,omitempty" doc:"Path param holding the value, for pathParam"`
+	MaxBodyBytes int64    `json:"maxBodyBytes,omitempty" doc:"Maximum number of bytes of the body to read, for body and hmac"`
+	Keys         string   `json:"keys,omitempty" doc:"File with the keys, for jwt and hmac"`
+	Secret       string   `json:"secret,omitempty" doc:"Shared secret of HS256 tokens, for jwt"`
+	Claim        string   `json:"claim,omitempty" doc:"Claim identifying the client, for jwt and introspection"`
+	Algorithms   []string `json:"algorithms,omitempty" doc:"Accepted algorithms, for jwt"`
+	Issuer       string   `json:"issuer,omitempty" doc:"Required issuer of tokens, for jwt"`
+	Audience     string   `json:"audience,omitempty" doc:"Required audience of tokens, for jwt"`
+	Leeway       string   `json:"leeway,omitempty" doc:"Clock skew allowed, like 30s, for jwt"`
+	RequireExp   bool     `json:"requireExp,omitempty" doc:"Reject tokens without exp, for jwt"`
+	Registry     string   `json:"registry,omitempty" doc:"File of the API key registry, for apiKey"`
+	Reload       string   `json:"reload,omitempty" doc:"How often the registry is reloaded, like 1m, for apiKey"`
+	Identity     string   `json:"identity,omitempty" doc:"Part of the certificate identifying the client, for clientCert" enum:"subject,dnsName,email,uri,spki"`
+	Skew         string   `json:"skew,omitempty" doc:"Maximum age of signatures, like 5m, for hmac"`
+	Endpoint     string   `json:"endpoint,omitempty" doc:"URL of the introspection endpoint, for introspection"`
+	ClientID     string   `json:"clientId,omitempty" doc:"Client id to authenticate to the endpoint, for introspection"`
+	ClientSecret string   `json:"clientSecret,omitempty" doc:"Client secret to authenticate to the endpoint, for introspection"`
+	MaxTTL       string   `json:"maxTTL,omitempty" doc:"Maximum time active tokens are remembered, for introspection"`
+	InactiveTTL  string   `json:"inactiveTTL,omitempty" doc:"Time inactive tokens are remembered, for introspection"`
+	FailCode     int      `json:"failCode,omitempty" doc:"Status code of the response to requests with an invalid value"`
+	FailMessage  string   `json:"failMessage,omitempty" doc:"Body of the response to requests with an invalid value"`
+}
+
+// What is done with the requests a route matches
+type policy struct {
+	Rates      map[string]string `json:"rates,omitempty" doc:"Maps names of RateBys to names of rates. Required when the action is limit"`
+	PlanRates  map[string]string `json:"planRates,omitempty" doc:"Maps plans to names of rates"`
+	Action     string            `json:"action,omitempty" doc:"What is done with the requests. Defaults to limit" enum:"limit,allow,deny,maintenance"`
+	Status     int               `json:"status,omitempty" doc:"Status code of the response, for deny. Defaults to 403"`
+	Body       string            `json:"body,omitempty" doc:"Body of the response, for deny and maintenance"`
+	RetryAfter string            `json:"retryAfter,omitempty" doc:"Time after which clients should try again, like 10m, for maintenance"`
+	Anonymous  *anonymous        `json:"anonymous,omitempty" doc:"What is done with requests that have none of the values the rateBys look for. They are rejected by default"`
+}
+
+type anonymous struct {
+	Policy string `json:"policy,omitempty" doc:"Whether the requests are rejected, rate limited by IP, rate limited together or allowed. Defaults to reject" enum:"reject,ip,together,allow"`
+	Rate   string `json:"rate,omitempty" doc:"Name of the rate, for ip and together"`
+	Status int    `json:"status,omitempty" doc:"Status code of the response, for reject. Defaults to 401"`
+	Body   string `json:"body,omitempty" doc:"Body of the response, for reject"`
+}
+
+type route struct {
+	Methods  []string `json:"methods,omitempty" doc:"Methods of requests the route matches. Required unless the route is in a group with methods"`
+	Pattern  string   `json:"pattern,omitempty" doc:"Regex the path of requests must match"`
+	Template string   `json:"template,omitempty" doc:"Template like /users/{id} the path of requests must match"`
+	policy
+	BucketBy    []string           `json:"bucketBy,omitempty" doc:"Params of the path that get separate buckets"`
+	Host        string             `json:"host,omitempty" doc:"Host of requests, like *.example.com"`
+	Headers     map[string]*string `json:"headers,omitempty" doc:"Maps headers to a regex their value must match, or null to require the header"`
+	Query       map[string]*string `json:"query,omitempty" doc:"Maps query parameters to a regex their value must match, or null to require the parameter"`
+	ContentType string             `json:"contentType,omitempty" doc:"Media type of the request body, like application/json or image/*"`
+}
+
+type group struct {
+	Prefix    string            `json:"prefix,omitempty" doc:"Path like /api/{tenant} prepended to the templates and patterns of the routes"`
+	Methods   []string          `json:"methods,omitempty" doc:"Methods of the routes that have none"`
+	Rates     map[string]string `json:"rates,omitempty" doc:"Maps names of RateBys to names of rates, added to those of the routes"`
+	PlanRates map[string]string `json:"planRates,omitempty" doc:"Maps plans to names of rates, added to those of the routes"`
+	Routes    []route           `json:"routes,omitempty" doc:"Routes of the group in the order they are matched"`
+	Groups    []group           `json:"groups,omitempty" doc:"Nested groups, whose routes are matched before routes"`
+}
+
+// A parsed file along with where its values are
+type parsedFile struct {
+	name      string
+	data      []byte
+	positions map[string]int64
+	file
+}
+
+// Build a configuration from the JSON file at path and the files it
+// includes. The returned error wraps an [*Error] for each problem found in the
+// files.
+//
+// If a RateBy of type apiKey has reload set, the registry keeps being
+// reloaded, and the log file stays open, for as long as the process runs. To
+// load the file again, as when reloading the configuration, use a
+// [FileLoader] instead.
+func Load(path string) (ursa.Conf, error) {
+	return NewFileLoader(path).Load()
+}
+
+// A FileLoader loads the configuration from the same file every time its Load
+// method is called, which makes it a [ursa.ConfLoader]:
+//
+//	loader := jsonconf.NewFileLoader("ursa.json")
+//	defer loader.Close()
+//	conf, err := loader.Load()
+//	...
+//	server.WatchConfFile("ursa.json", 10*time.Second, loader.Load, onError)
+//
+// Unlike calling [Load] repeatedly, it doesn't leak what the configuration
+// holds on to. Once a load succeeds, the API key registries of the previous
+// load stop being reloaded. The log file is opened once and kept, as the
+// server keeps writing to the log file it started with.
+//
+// A FileLoader is safe for concurrent use.
+type FileLoader struct {
+	path     string
+	mu       sync.Mutex
+	logfiles map[string]*os.File // Log files opened, by path
+	stops    []func()            // Stop reloading the registries of the last load
+}
+
+// Create a FileLoader for the JSON file at path
+func NewFileLoader(path string) *FileLoader {
+	return &FileLoader{path: path, logfiles: make(map[string]*os.File)}
+}
+
+// Build a configuration from the file of the loader and the files it
+// includes, like [Load] does
+func (fl *FileLoader) Load() (ursa.Conf, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	l := &loader{
+		rates:    make(map[string]ursa.Rate),
+		rateBys:  map[string]*ursa.RateBy{"ip": ursa.RateByIP},
+		plans:    make(map[string]string),
+		defined:  make(map[string]*parsedFile),
+		loading:  make(map[string]bool),
+		loaded:   make(map[string]*parsedFile),
+		logfiles: fl.logfiles,
+	}
+	main, err := l.load(fl.path)
+	if err == nil {
+		conf := l.conf(main)
+		if err = errors.Join(l.errs...); err == nil {
+			stopAll(fl.stops)
+			fl.stops = l.stops
+			return conf, nil
+		}
+	}
+	stopAll(l.stops)
+	return ursa.Conf{}, err
+}
+
+// Stop reloading the API key registries and close the log files. The
+// configurations loaded must no longer be used.
+func (fl *FileLoader) Close() error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	stopAll(fl.stops)
+	fl.stops = nil
+	var errs []error
+	for path, f := range fl.logfiles {
+		errs = append(errs, f.Close())
+		delete(fl.logfiles, path)
+	}
+	return errors.Join(errs...)
+}
+
+func stopAll(stops []func()) {
+	for _, stop := range stops {
+		stop()
+	}
+}
+
+type loader struct {
+	rates    map[string]ursa.Rate
+	rateBys  map[string]*ursa.RateBy
+	plans    map[string]string
+	defined  map[string]*parsedFile // Maps names of rates and RateBys to the file defining them
+	loading  map[string]bool        // Files being loaded, to detect include cycles
+	loaded   map[string]*parsedFile // Files already loaded by absolute path, so that they are loaded once
+	files    []*parsedFile          // Files in the order their routes come
+	logfiles map[string]*os.File    // Log files already open, by path
+	stops    []func()               // Stop reloading the registries loaded
+	errs     []error
+}
+
+// Records an error at the value with the path in the file
+func (l *loader) errorf(f *parsedFile, path string, format string, args ...any) {
+	l.errs = append(l.errs, f.errorAt(path, fmt.Errorf(format, args...)))
+}
+
+// Reads the file and the files it includes, and defines the rates and
+// RateBys in them. A file included more than once is only loaded the first
+// time. An error is returned only if a file can't be read or parsed, the rest
+// are recorded in l.errs.
+func (l *loader) load(path string) (*parsedFile, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := l.loaded[abs]; ok {
+		return f, nil
+	}
+	if l.loading[abs] {
+		return nil, fmt.Errorf("%v: included in itself", path)
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parse(path, data)
+	if err != nil {
+		return nil, err
+	}
+	for i, inc := range f.Include {
+		if _, err := l.load(f.resolve(inc)); err != nil {
+			return nil, f.errorAt(fmt.Sprintf("include[%d]", i), err)
+		}
+	}
+	l.files = append(l.files, f)
+	l.loaded[abs] = f
+
+	for _, name := range sortedKeys(f.Rates) {
+		if !l.define(f, "rates."+name, name) {
+			continue
+		}
+		if r, err := f.Rates[name].build(); err != nil {
+			l.errorf(f, "rates."+name, "%v", err)
+		} else {
+			l.rates[name] = r
+		}
+	}
+	for _, name := range sortedKeys(f.RateBys) {
+		if !l.define(f, "rateBys."+name, name) {
+			continue
+		}
+		if by, err := f.RateBys[name].build(l, f); err != nil {
+			l.errorf(f, "rateBys."+name, "%v", err)
+		} else {
+			l.rateBys[name] = by
+		}
+	}
+	for sig, plan := range f.Plans {
+		l.plans[sig] = plan
+	}
+	return f, nil
+}
+
+// Checks that the rate or RateBy at the path isn't already defined
+func (l *loader) define(f *parsedFile, path, name string) bool {
+	if path == "rateBys.ip" {
+		l.errorf(f, path, "the RateBy ip is built in and can't be redefined")
+		return false
+	}
+	if prev, ok := l.defined[path]; ok {
+		l.errorf(f, path, "%v is already defined in %v", name, prev.name)
+		return false
+	}
+	l.defined[path] = f
+	return true
+}
+
+// Builds the configuration from the main file and the routes of all files
+func (l *loader) conf(main *parsedFile) ursa.Conf {
+	var conf ursa.Conf
+	for _, f := range l.files {
+		if f != main {
+			f.checkIncluded(l)
+		}
+		for i, def := range f.Groups {
+			conf.Groups = append(conf.Groups, l.group(f, fmt.Sprintf("groups[%d]", i), def))
+		}
+		for i, def := range f.Routes {
+			if r, ok := l.route(f, fmt.Sprintf("routes[%d]", i), def); ok {
+				conf.Routes = append(conf.Routes, r)
+			}
+		}
+	}
+	if len(l.plans) > 0 {
+		conf.Plans = ursa.NewPlanTable(l.plans)
+	}
+
+	if main.Upstream == "" {
+		l.errorf(main, "", "upstream is required")
+	} else if u, err := url.Parse(main.Upstream); err != nil {
+		l.errorf(main, "upstream", "%v", err)
+	} else {
+		conf.Upstream = u
+	}
+	if main.Logfile != "" {
+		path := main.resolve(main.Logfile)
+		if file, ok := l.logfiles[path]; ok {
+			conf.Logfile = file
+		} else if file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			l.errorf(main, "logfile", "%v", err)
+		} else {
+			l.logfiles[path] = file
+			conf.Logfile = file
+		}
+	}
+	conf.RouteCacheSize = main.RouteCacheSize
+	conf.CustomMethods = main.CustomMethods
+	if n := main.PathNormalization; n != nil {
+		conf.PathNormalization = ursa.PathNormalization{Raw: n.Raw, FoldCase: n.FoldCase}
+		switch n.TrailingSlash {
+		case "", "keep":
+			conf.PathNormalization.TrailingSlash = ursa.KeepTrailingSlash
+		case "strip":
+			conf.PathNormalization.TrailingSlash = ursa.StripTrailingSlash
+		case "append":
+			conf.PathNormalization.TrailingSlash = ursa.AppendTrailingSlash
+		default:
+			l.errorf(main, "pathNormalization.trailingSlash", "unknown trailing slash policy %q", n.TrailingSlash)
+		}
+	}
+	switch main.MethodOverride {
+	case "", "strip":
+		conf.MethodOverride = ursa.StripMethodOverride
+	case "apply":
+		conf.MethodOverride = ursa.ApplyMethodOverride
+	case "reject":
+		conf.MethodOverride = ursa.RejectMethodOverride
+	default:
+		l.errorf(main, "methodOverride", "unknown method override policy %q", main.MethodOverride)
+	}
+	if h := main.RateLimitHeaders; h != nil {
+		jitter, err := parseDuration("retryAfterJitter", h.RetryAfterJitter)
+		if err != nil {
+			l.errorf(main, "rateLimitHeaders.retryAfterJitter", "%v", err)
+		}
+		conf.RateLimitHeaders = ursa.RateLimitHeaders{Omit: h.Omit, Legacy: h.Legacy, RetryAfterJitter: jitter}
+	}
+	if main.Fallback != nil {
+		fallback := &ursa.Route{}
+		l.applyPolicy(main, "fallback", *main.Fallback, fallback)
+		conf.Fallback = fallback
+	}
+	if main.Overrides != "" {
+		overrides, err := ursa.NewOverrides(main.resolve(main.Overrides))
+		if err != nil {
+			l.errorf(main, "overrides", "%v", err)
+		} else {
+			conf.Overrides = overrides
+		}
+	}
+	return conf
+}
+
+// Records errors for the fields that are only allowed in the main file
+func (f *parsedFile) checkIncluded(l *loader) {
+	fields := map[string]bool{
+		"upstream":          f.Upstream != "",
+		"logfile":           f.Logfile != "",
+		"routeCacheSize":    f.RouteCacheSize != 0,
+		"pathNormalization": f.PathNormalization != nil,
+		"methodOverride":    f.MethodOverride != "",
+		"customMethods":     f.CustomMethods != nil,
+		"overrides":         f.Overrides != "",
+		"fallback":          f.Fallback != nil,
+		"rateLimitHeaders":  f.RateLimitHeaders != nil,
+	}
+	for _, field := range sortedKeys(fields) {
+		if fields[field] {
+			l.errorf(f, field, "%v is only allowed in the main file", field)
+		}
+	}
+}
+
+// Builds the group defined at the path in the file, leaving out the routes
+// with errors
+func (l *loader) group(f *parsedFile, at string, def group) ursa.RouteGroup {
+	g := ursa.RouteGroup{
+		Prefix:    def.Prefix,
+		Methods:   def.Methods,
+		Rates:     l.routeRates(f, at, def.Rates),
+		PlanRates: l.planRates(f, at, def.PlanRates),
+	}
+	for i, sub := range def.Groups {
+		g.Groups = append(g.Groups, l.group(f, fmt.Sprintf("%v.groups[%d]", at, i), sub))
+	}
+	for i, rdef := range def.Routes {
+		if r, ok := l.route(f, fmt.Sprintf("%v.routes[%d]", at, i), rdef); ok {
+			g.Routes = append(g.Routes, r)
+		}
+	}
+	return g
+}
+
+// Builds the route defined at the path in the file
+func (l *loader) route(f *parsedFile, at string, def route) (ursa.Route, bool) {
+	nErrs := len(l.errs)
+	r := ursa.Route{
+		Methods:     def.Methods,
+		Template:    def.Template,
+		BucketBy:    def.BucketBy,
+		Host:        def.Host,
+		ContentType: def.ContentType,
+	}
+	if def.Pattern != "" {
+		pattern, err := regexp.Compile(def.Pattern)
+		if err != nil {
+			l.errorf(f, at+".pattern", "%v", err)
+		}
+		r.Pattern = pattern
+	} else if def.Template == "" {
+		l.errorf(f, at, "route needs a pattern or a template")
+	}
+	l.applyPolicy(f, at, def.policy, &r)
+	r.Headers = l.regexps(f, at+".headers", def.Headers)
+	r.Query = l.regexps(f, at+".query", def.Query)
+	return r, len(l.errs) == nErrs
+}
+
+var actions = map[string]ursa.Action{
+	"":            ursa.LimitAction,
+	"limit":       ursa.LimitAction,
+	"allow":       ursa.AllowAction,
+	"deny":        ursa.DenyAction,
+	"maintenance": ursa.MaintenanceAction,
+}
+
+// Sets the rates and the action of the route defined at the path in the file
+func (l *loader) applyPolicy(f *parsedFile, at string, def policy, r *ursa.Route) {
+	r.Rates = l.routeRates(f, at, def.Rates)
+	r.PlanRates = l.planRates(f, at, def.PlanRates)
+	action, ok := actions[def.Action]
+	if !ok {
+		l.errorf(f, at+".action", "unknown action %q", def.Action)
+	}
+	retryAfter, err := parseDuration("retryAfter", def.RetryAfter)
+	if err != nil {
+		l.errorf(f, at+".retryAfter", "%v", err)
+	}
+	r.Action, r.Status, r.Body, r.RetryAfter = action, def.Status, def.Body, retryAfter
+	if def.Anonymous != nil {
+		r.Anonymous = l.anonymous(f, at+".anonymous", *def.Anonymous)
+	}
+}
+
+// Resolves the names in the rates of the route or group defined at the path
+// in the file
+func (l *loader) routeRates(f *parsedFile, at string, def map[string]string) ursa.RouteRates {
+	if def == nil {
+		return nil
+	}
+	rates := make(ursa.RouteRates)
+	for _, byName := range sortedKeys(def) {
+		by, ok := l.rateBys[byName]
+		if !ok {
+			l.errorf(f, at+".rates."+byName, "unknown RateBy %q", byName)
+		}
+		rate, ok := l.rates[def[byName]]
+		if !ok {
+			l.errorf(f, at+".rates."+byName, "unknown rate %q", def[byName])
+		}
+		rates[by] = rate
+	}
+	return rates
+}
+
+// Resolves the names in the plan rates of the route or group defined at the
+// path in the file
+func (l *loader) planRates(f *parsedFile, at string, def map[string]string) map[string]ursa.Rate {
+	if len(def) == 0 {
+		return nil
+	}
+	rates := make(map[string]ursa.Rate)
+	for _, plan := range sortedKeys(def) {
+		rate, ok := l.rates[def[plan]]
+		if !ok {
+			l.errorf(f, at+".planRates."+plan, "unknown rate %q", def[plan])
+		}
+		rates[plan] = rate
+	}
+	return rates
+}
+
+var anonymousPolicies = map[string]ursa.AnonymousPolicy{
+	"":         ursa.RejectAnonymous,
+	"reject":   ursa.RejectAnonymous,
+	"ip":       ursa.LimitAnonymousByIP,
+	"together": ursa.LimitAnonymousTogether,
+	"allow":    ursa.AllowAnonymous,
+}
+
+// Builds what is done with anonymous requests to the route, defined at the
+// path in the file
+func (l *loader) anonymous(f *parsedFile, at string, def anonymous) ursa.Anonymous {
+	a := ursa.Anonymous{Status: def.Status, Body: def.Body}
+	policy, ok := anonymousPolicies[def.Policy]
+	if !ok {
+		l.errorf(f, at+".policy", "unknown anonymous policy %q", def.Policy)
+	}
+	a.Policy = policy
+	if def.Rate != "" {
+		rate, ok := l.rates[def.Rate]
+		if !ok {
+			l.errorf(f, at+".rate", "unknown rate %q", def.Rate)
+		}
+		a.Rate = rate
+	}
+	return a
+}
+
+// Compiles the regexes of the headers or query parameters of a route
+func (l *loader) regexps(f *parsedFile, at string, defs map[string]*string) map[string]*regexp.Regexp {
+	if len(defs) == 0 {
+		return nil
+	}
+	m := make(map[string]*regexp.Regexp, len(defs))
+	for name, def := range defs {
+		if def == nil {
+			m[name] = nil
+			continue
+		}
+		re, err := regexp.Compile(*def)
+		if err != nil {
+			l.errorf(f, at+"."+name, "%v", err)
+			continue
+		}
+		m[name] = re
+	}
+	return m
+}
+
+func (r rate) build() (ursa.Rate, error) {
+	if r.Capacity <= 0 {
+		return ursa.Rate{}, fmt.Errorf("capacity must be positive")
+	}
+	switch r.Per {
+	case "minute":
+		return ursa.NewRate(r.Capacity, ursa.Minute), nil
+	case "hour":
+		return ursa.NewRate(r.Capacity, ursa.Hour), nil
+	case "day":
+		return ursa.NewRate(r.Capacity, ursa.Day), nil
+	}
+	return ursa.Rate{}, fmt.Errorf("per must be minute, hour or day, not %q", r.Per)
+}
+
+// Parses the duration if it isn't empty
+func parseDuration(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %w", field, err)
+	}
+	return d, nil
+}
+
+// Returns the path relative to the directory of the file
+func (f *parsedFile) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(f.name), path)
+}
+
+// Parses the JSON document, reporting syntax errors and unknown fields with
+// their position
+func parse(name string, data []byte) (*parsedFile, error) {
+	f := &parsedFile{name: name, data: data}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// The offset is just after the character that is invalid
+			return nil, f.errorAtOffset(syntaxErr.Offset-1, syntaxErr)
+		}
+		return nil, f.errorAtOffset(int64(len(data)), err)
+	}
+	positions, err := indexPositions(data)
+	if err != nil {
+		return nil, f.errorAtOffset(0, err)
+	}
+	f.positions = positions
+	if err := decodeStrict(data, &f.file); err != nil {
+		return nil, f.decodeError(err)
+	}
+	return f, nil
+}
@@ -0,0 +1,473 @@
+package jsonconf
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ursaserver/ursa"
+)
+
+// Writes the files to a temporary directory and returns the directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer upstream.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"main.json": `{
+	"include": ["rates.json"],
+	"upstream": "` + upstream.URL + `",
+	"logfile": "ursa.log",
+	"methodOverride": "reject",
+	"pathNormalization": {"trailingSlash": "strip"},
+	"rateBys": {
+		"user": {"type": "header", "header": "User", "failCode": 400}
+	},
+	"routes": [
+		{
+			"methods": ["GET"],
+			"template": "/users/{id}",
+			"rates": {"ip": "one", "user": "two"},
+			"headers": {"X-Beta": null}
+		},
+		{
+			"methods": ["safe"],
+			"pattern": "^/users",
+			"rates": {"user": "one"}
+		}
+	]
+}`,
+		"rates.json": `{
+	"rates": {
+		"one": {"capacity": 1, "per": "hour"},
+		"two": {"capacity": 2, "per": "minute"}
+	},
+	"routes": [
+		{"methods": ["POST"], "template": "/login", "rates": {"ip": "one"}}
+	]
+}`,
+	})
+	conf, err := Load(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Routes) != 3 || conf.Routes[0].Template != "/login" {
+		t.Fatalf("expected the route of the included file to come first, got %v", conf.Routes)
+	}
+	if conf.MethodOverride != ursa.RejectMethodOverride ||
+		conf.PathNormalization.TrailingSlash != ursa.StripTrailingSlash {
+		t.Error("expected the policies in the file")
+	}
+	var user *ursa.RateBy
+	for by, rate := range conf.Routes[1].Rates {
+		if by != ursa.RateByIP {
+			user = by
+			if rate != ursa.NewRate(2, ursa.Minute) {
+				t.Errorf("expected rate two got %v", rate)
+			}
+		}
+	}
+	if _, ok := conf.Routes[2].Rates[user]; !ok {
+		t.Error("expected routes to share the RateBy with the same name")
+	}
+	if _, ok := conf.Routes[1].Headers["X-Beta"]; !ok {
+		t.Error("expected the header condition of the route")
+	}
+
+	s := ursa.New(conf)
+	type test struct {
+		method  string
+		path    string
+		user    string
+		expCode int
+	}
+	tests := []test{
+		{method: "POST", path: "/login", expCode: 200},
+		{method: "POST", path: "/login", expCode: 429},
+		{method: "GET", path: "/users", expCode: ursa.HeaderValueNotFoundInRequestForRateLimiting},
+		{method: "GET", path: "/users/", user: "alice", expCode: 200},
+		{method: "HEAD", path: "/users", user: "alice", expCode: 429},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.user != "" {
+			r.Header.Set("User", test.user)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+	}
+}
+
+func TestLoadSharedInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.json": `{"include": ["a.json", "b.json"], "upstream": "http://localhost:8000"}`,
+		"a.json": `{"include": ["common.json"],
+	"routes": [{"methods": ["GET"], "template": "/a", "rates": {"ip": "one"}}]}`,
+		"b.json": `{"include": ["common.json"],
+	"routes": [{"methods": ["GET"], "template": "/b", "rates": {"ip": "one"}}]}`,
+		"common.json": `{"rates": {"one": {"capacity": 1, "per": "hour"}},
+	"routes": [{"methods": ["GET"], "template": "/common", "rates": {"ip": "one"}}]}`,
+	})
+	conf, err := Load(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var templates []string
+	for _, r := range conf.Routes {
+		templates = append(templates, r.Template)
+	}
+	if got := strings.Join(templates, " "); got != "/common /a /b" {
+		t.Errorf("expected the routes of the file included twice once, got %v", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	type test struct {
+		files  map[string]string
+		expErr []string // Each of the errors in order
+	}
+	tests := []test{
+		{
+			files:  map[string]string{"main.json": "{\n\t\"upstream\": \"http://localhost\",\n\t\"routes\": [\n}"},
+			expErr: []string{"main.json:4:1: invalid character"},
+		},
+		{
+			files:  map[string]string{"main.json": "{\n\t\"upstream\": \"http://localhost\",\n\t\"rotues\": []\n}"},
+			expErr: []string{`main.json:3:12: unknown field "rotues"`},
+		},
+		{
+			files:  map[string]string{"main.json": "{\n\t\"upstream\": 8000\n}"},
+			expErr: []string{"main.json:2:18: json: cannot unmarshal number"},
+		},
+		{
+			files: map[string]string{"main.json": `{
+	"upstream": "http://localhost",
+	"rates": {"one": {"capacity": 0, "per": "hour"}},
+	"rateBys": {"user": {"type": "magic"}},
+	"routes": [
+		{"methods": ["GET"], "pattern": "^/(", "rates": {"ip": "two", "admin": "one"}}
+	]
+}`},
+			expErr: []string{
+				"main.json:3:19: rates.one: capacity must be positive",
+				`main.json:4:22: rateBys.user: unknown type "magic"`,
+				"main.json:6:35: routes[0].pattern: error parsing regexp",
+				`main.json:6:74: routes[0].rates.admin: unknown RateBy "admin"`,
+				`main.json:6:74: routes[0].rates.admin: unknown rate "one"`,
+				`main.json:6:58: routes[0].rates.ip: unknown rate "two"`,
+			},
+		},
+		{
+			files: map[string]string{
+				"main.json": `{"include": ["a.json"], "upstream": "http://localhost",
+	"rates": {"one": {"capacity": 1, "per": "hour"}}}`,
+				"a.json": `{"rates": {"one": {"capacity": 1, "per": "hour"}}, "upstream": "http://other"}`,
+			},
+			expErr: []string{
+				"main.json:2:19: rates.one: one is already defined in a.json",
+				"a.json:1:64: upstream: upstream is only allowed in the main file",
+			},
+		},
+		{
+			files: map[string]string{
+				"main.json": `{"include": ["a.json"], "upstream": "http://localhost"}`,
+				"a.json":    `{"include": ["main.json"]}`,
+			},
+			expErr: []string{"main.json:1:14: include[0]: ", "a.json:1:14: include[0]: ", "main.json: included in itself"},
+		},
+		{
+			files: map[string]string{"main.json": `{
+	"upstream": "http://localhost",
+	"routes": [{"methods": ["GET"], "template": "/a", "action": "block", "retryAfter": "soon"}],
+	"fallback": {"rates": {"ip": "none"}}
+}`},
+			expErr: []string{
+				`main.json:3:62: routes[0].action: unknown action "block"`,
+				`main.json:3:85: routes[0].retryAfter: retryAfter: time: invalid duration "soon"`,
+				`main.json:4:31: fallback.rates.ip: unknown rate "none"`,
+			},
+		},
+		{
+			files: map[string]string{"main.json": `{
+	"upstream": "http://localhost",
+	"groups": [{"prefix": "/api", "rates": {"ip": "none"}, "groups": [
+		{"routes": [{"template": "/a", "action": "block"}]}
+	]}]
+}`},
+			expErr: []string{
+				`main.json:3:48: groups[0].rates.ip: unknown rate "none"`,
+				`main.json:4:44: groups[0].groups[0].routes[0].action: unknown action "block"`,
+			},
+		},
+	}
+	for i, test := range tests {
+		dir := writeFiles(t, test.files)
+		_, err := Load(filepath.Join(dir, "main.json"))
+		if err == nil {
+			t.Errorf("case %d: expected error", i)
+			continue
+		}
+		var confErr *Error
+		if !errors.As(err, &confErr) {
+			t.Errorf("case %d: expected a jsonconf.Error got %T", i, err)
+		}
+		got := strings.ReplaceAll(err.Error(), dir+string(filepath.Separator), "")
+		rest := got
+		for _, exp := range test.expErr {
+			idx := strings.Index(rest, exp)
+			if idx < 0 {
+				t.Errorf("case %d: expected error containing %q got %q", i, exp, got)
+				break
+			}
+			rest = rest[idx+len(exp):]
+		}
+	}
+}
+
+func TestLoadGroups(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer upstream.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"main.json": `{
+	"include": ["admin.json"],
+	"upstream": "` + upstream.URL + `",
+	"rates": {
+		"one": {"capacity": 1, "per": "hour"},
+		"two": {"capacity": 2, "per": "hour"}
+	},
+	"groups": [
+		{
+			"prefix": "/api",
+			"methods": ["GET"],
+			"rates": {"ip": "two"},
+			"groups": [
+				{"prefix": "/v1", "routes": [{"template": "/users/{id}", "rates": {"ip": "one"}}]}
+			],
+			"routes": [
+				{"template": "/orders"},
+				{"methods": ["POST"], "pattern": "^/orders$"}
+			]
+		}
+	],
+	"routes": [{"methods": ["GET"], "pattern": "^/", "action": "allow"}]
+}`,
+		"admin.json": `{
+	"groups": [{"prefix": "/admin", "methods": ["GET"], "routes": [{"template": "/", "action": "deny"}]}]
+}`,
+	})
+	conf, err := Load(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Groups) != 2 || conf.Groups[0].Prefix != "/admin" {
+		t.Fatalf("expected the group of the included file to come first, got %v", conf.Groups)
+	}
+	if g := conf.Groups[1]; len(g.Groups) != 1 || len(g.Routes) != 2 || g.Routes[0].Methods != nil {
+		t.Errorf("expected the nested group and the routes as defined, got %v", g)
+	}
+
+	s := ursa.New(conf)
+	type test struct {
+		method  string
+		path    string
+		expCode int
+	}
+	tests := []test{
+		{method: "GET", path: "/api/v1/users/1", expCode: 200},
+		{method: "GET", path: "/api/v1/users/1", expCode: 429},
+		{method: "GET", path: "/api/orders", expCode: 200},
+		{method: "GET", path: "/api/orders", expCode: 200},
+		{method: "GET", path: "/api/orders", expCode: 429},
+		{method: "POST", path: "/api/orders", expCode: 200},
+		{method: "GET", path: "/admin/", expCode: 403},
+		{method: "GET", path: "/orders", expCode: 200},
+	}
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+	}
+}
+
+func TestLoadActions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer upstream.Close()
+
+	dir := writeFiles(t, map[string]string{"main.json": `{
+	"upstream": "` + upstream.URL + `",
+	"rates": {"one": {"capacity": 1, "per": "hour"}},
+	"routes": [
+		{"methods": ["GET"], "template": "/health", "action": "allow"},
+		{"methods": ["ANY"], "template": "/admin/*", "action": "deny", "status": 404, "body": "not found"},
+		{"methods": ["GET"], "template": "/reports", "action": "maintenance", "retryAfter": "2m"},
+		{
+			"methods": ["GET"],
+			"template": "/feed",
+			"rates": {"user": "one"},
+			"anonymous": {"policy": "together", "rate": "one"}
+		}
+	],
+	"rateBys": {"user": {"type": "header", "header": "User"}},
+	"fallback": {"rates": {"ip": "one"}},
+	"rateLimitHeaders": {"legacy": true, "retryAfterJitter": "5s"}
+}`})
+	conf, err := Load(filepath.Join(dir, "main.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := conf.RateLimitHeaders; !h.Legacy || h.RetryAfterJitter != 5*time.Second {
+		t.Errorf("expected the rate limit headers in the file got %+v", h)
+	}
+	s := ursa.New(conf)
+	type test struct {
+		path          string
+		expCode       int
+		expRetryAfter string
+	}
+	tests := []test{
+		{path: "/health", expCode: 200},
+		{path: "/health", expCode: 200},
+		{path: "/admin/users", expCode: 404},
+		{path: "/reports", expCode: 503, expRetryAfter: "120"},
+		{path: "/other", expCode: 200},
+		{path: "/other", expCode: 429},
+		{path: "/feed", expCode: 200},
+		{path: "/feed", expCode: 429},
+	}
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); test.expRetryAfter != "" && got != test.expRetryAfter {
+			t.Errorf("case %d: expected Retry-After %q got %q", i, test.expRetryAfter, got)
+		}
+	}
+}
+
+func TestSchemaIsUpToDate(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file) != string(schema)+"\n" {
+		t.Error("schema.json is out of date, run go generate")
+	}
+}
+
+// Reports whether the API key RateBy of the first route of the configuration
+// accepts the key
+func acceptsKey(conf ursa.Conf, key string) bool {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", key)
+	for by := range conf.Routes[0].Rates {
+		if _, err := by.Extract(r.Context(), r); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Waits for the condition to hold, reporting whether it did in time
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFileLoader(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.json": `{
+	"upstream": "http://localhost:8000",
+	"logfile": "ursa.log",
+	"rates": {"one": {"capacity": 1, "per": "hour"}},
+	"rateBys": {"key": {"type": "apiKey", "registry": "keys.json", "reload": "10ms"}},
+	"routes": [{"methods": ["GET"], "template": "/", "rates": {"key": "one"}}]
+}`,
+		"keys.json": `{"keys": [{"id": "acme", "key": "acme-key"}]}`,
+	})
+	loader := NewFileLoader(filepath.Join(dir, "main.json"))
+	var logfile io.Writer
+	var confs []ursa.Conf
+	for i := 0; i < 3; i++ {
+		conf, err := loader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logfile == nil {
+			logfile = conf.Logfile
+		} else if conf.Logfile != logfile {
+			t.Fatal("expected the log file to be opened once")
+		}
+		confs = append(confs, conf)
+	}
+	last := confs[len(confs)-1]
+
+	// Only the registry of the last load is still being reloaded
+	writeKeys := func(keys string) {
+		if err := os.WriteFile(filepath.Join(dir, "keys.json"), []byte(`{"keys": [`+keys+`]}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys(`{"id": "acme", "key": "acme-key"}, {"id": "bolt", "key": "bolt-key"}`)
+	if !eventually(func() bool { return acceptsKey(last, "bolt-key") }) {
+		t.Fatal("expected the registry of the last load to be reloaded")
+	}
+	for i, conf := range confs[:len(confs)-1] {
+		if acceptsKey(conf, "bolt-key") {
+			t.Errorf("load %d: expected the registry of an earlier load to no longer be reloaded", i)
+		}
+	}
+
+	// A failed load keeps the registries of the last successful one
+	os.WriteFile(filepath.Join(dir, "main.json"), []byte(`{"routes": []}`), 0o644)
+	if _, err := loader.Load(); err == nil {
+		t.Error("expected an error for a file without upstream")
+	}
+	writeKeys(`{"id": "acme", "key": "acme-key"}, {"id": "bolt", "key": "bolt-key"}, {"id": "cask", "key": "cask-key"}`)
+	if !eventually(func() bool { return acceptsKey(last, "cask-key") }) {
+		t.Error("expected the registry of the last successful load to be reloaded")
+	}
+
+	if err := loader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys(`{"id": "dart", "key": "dart-key"}`)
+	time.Sleep(100 * time.Millisecond)
+	if acceptsKey(last, "dart-key") || !acceptsKey(last, "acme-key") {
+		t.Error("expected the registry to no longer be reloaded once closed")
+	}
+	if _, err := logfile.Write([]byte("x")); err == nil {
+		t.Error("expected the log file to be closed")
+	}
+}
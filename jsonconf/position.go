@@ -0,0 +1,140 @@
+package jsonconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An Error is a problem in a configuration file, found at Line and Column of
+// File. Line and Column start at 1.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Returns the error at the value with the path, like "routes[2].rates.user",
+// in the file. An empty path is the whole document.
+func (f *parsedFile) errorAt(path string, err error) *Error {
+	if path != "" {
+		err = fmt.Errorf("%v: %w", path, err)
+	}
+	return f.errorAtOffset(f.positions[path], err)
+}
+
+// Returns the error at the byte offset in the file
+func (f *parsedFile) errorAtOffset(offset int64, err error) *Error {
+	offset = max(0, min(offset, int64(len(f.data))))
+	before := f.data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return &Error{File: f.name, Line: line, Column: column, Err: err}
+}
+
+// Decodes the document, rejecting fields that aren't known
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Returns the error of decoding the document with its position
+func (f *parsedFile) decodeError(err error) *Error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return f.errorAtOffset(typeErr.Offset, err)
+	}
+	// Errors for unknown fields have no offset, so the first value of the
+	// field is used as its position
+	msg := err.Error()
+	if field, ok := strings.CutPrefix(msg, "json: unknown field "); ok {
+		name, _ := strconv.Unquote(field)
+		best := int64(-1)
+		for path, offset := range f.positions {
+			if (path == name || strings.HasSuffix(path, "."+name)) && (best < 0 || offset < best) {
+				best = offset
+			}
+		}
+		if best >= 0 {
+			return f.errorAtOffset(best, fmt.Errorf("unknown field %q", name))
+		}
+	}
+	return f.errorAtOffset(0, err)
+}
+
+// Returns the offsets at which the values of the document start, by their
+// path like "routes[2].rates.user". The document is expected to be valid JSON.
+func indexPositions(data []byte) (map[string]int64, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	positions := make(map[string]int64)
+	// Skips the whitespace and separators before the next value
+	start := func() int64 {
+		off := dec.InputOffset()
+		for off < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[off]) >= 0 {
+			off++
+		}
+		return off
+	}
+	var walk func(path string) error
+	walk = func(path string) error {
+		positions[path] = start()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := key.(string)
+				if path != "" {
+					child = path + "." + child
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%v[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+		return err
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// Returns the keys of the map in order, so that errors are reported in the
+// same order every time
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,179 @@
+package jsonconf
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ursaserver/ursa"
+)
+
+// Status code of the response to requests with an invalid value when a
+// RateBy doesn't set failCode
+const DefaultFailCode = http.StatusUnauthorized
+
+var certIdentities = map[string]ursa.CertIdentity{
+	"subject": ursa.CertSubject,
+	"dnsName": ursa.CertDNSName,
+	"email":   ursa.CertEmailAddress,
+	"uri":     ursa.CertURI,
+	"spki":    ursa.CertSPKIFingerprint,
+}
+
+// Values read from headers, cookies, query parameters and bodies are valid
+// if they aren't empty and are their own signature
+func nonEmpty(s string) bool   { return s != "" }
+func identity(s string) string { return s }
+
+// Builds the RateBy defined in the file
+func (def rateBy) build(l *loader, f *parsedFile) (*ursa.RateBy, error) {
+	failCode := def.FailCode
+	if failCode == 0 {
+		failCode = DefaultFailCode
+	}
+	required := func(field, value string) error {
+		if value == "" {
+			return fmt.Errorf("%v is required for RateBys of type %v", field, def.Type)
+		}
+		return nil
+	}
+
+	switch def.Type {
+	case "header":
+		if err := required("header", def.Header); err != nil {
+			return nil, err
+		}
+		return ursa.NewRateBy(def.Header, nonEmpty, identity, failCode, def.FailMessage), nil
+	case "cookie":
+		if err := required("cookie", def.Cookie); err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByCookie(def.Cookie, nonEmpty, identity, failCode, def.FailMessage), nil
+	case "query":
+		if err := required("query", def.Query); err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByQuery(def.Query, nonEmpty, identity, failCode, def.FailMessage), nil
+	case "body":
+		if err := required("field", def.Field); err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByBodyField(def.Field, def.MaxBodyBytes, nonEmpty, identity, failCode, def.FailMessage), nil
+	case "pathParam":
+		if err := required("param", def.Param); err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByPathParam(def.Param), nil
+	case "jwt":
+		return def.buildJWT(f, failCode)
+	case "apiKey":
+		if err := required("registry", def.Registry); err != nil {
+			return nil, err
+		}
+		reload, err := parseDuration("reload", def.Reload)
+		if err != nil {
+			return nil, err
+		}
+		reg, err := ursa.LoadAPIKeyRegistry(f.resolve(def.Registry))
+		if err != nil {
+			return nil, err
+		}
+		if reload > 0 {
+			l.stops = append(l.stops, reg.Watch(reload, nil))
+		}
+		header := def.Header
+		if header == "" {
+			header = "X-API-Key"
+		}
+		return ursa.NewRateByAPIKey(header, reg, failCode, def.FailMessage), nil
+	case "clientCert":
+		identity, ok := certIdentities[def.Identity]
+		if def.Identity == "" {
+			identity, ok = ursa.CertSubject, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown certificate identity %q", def.Identity)
+		}
+		return ursa.NewRateByClientCert(identity, failCode, def.FailMessage), nil
+	case "hmac":
+		if err := required("keys", def.Keys); err != nil {
+			return nil, err
+		}
+		skew, err := parseDuration("skew", def.Skew)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := ursa.LoadHMACKeys(f.resolve(def.Keys))
+		if err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByHMAC(ursa.HMACConf{
+			Keys:         keys,
+			Skew:         skew,
+			MaxBodyBytes: def.MaxBodyBytes,
+			FailCode:     failCode,
+			FailMsg:      def.FailMessage,
+		})
+	case "introspection":
+		if err := required("endpoint", def.Endpoint); err != nil {
+			return nil, err
+		}
+		maxTTL, err := parseDuration("maxTTL", def.MaxTTL)
+		if err != nil {
+			return nil, err
+		}
+		inactiveTTL, err := parseDuration("inactiveTTL", def.InactiveTTL)
+		if err != nil {
+			return nil, err
+		}
+		return ursa.NewRateByIntrospection(ursa.IntrospectionConf{
+			Endpoint:     def.Endpoint,
+			ClientID:     def.ClientID,
+			ClientSecret: def.ClientSecret,
+			Header:       def.Header,
+			Claim:        def.Claim,
+			MaxTTL:       maxTTL,
+			InactiveTTL:  inactiveTTL,
+			FailCode:     failCode,
+			FailMsg:      def.FailMessage,
+		})
+	case "":
+		return nil, fmt.Errorf("type is required")
+	}
+	return nil, fmt.Errorf("unknown type %q", def.Type)
+}
+
+func (def rateBy) buildJWT(f *parsedFile, failCode int) (*ursa.RateBy, error) {
+	var keys *ursa.JWTKeys
+	switch {
+	case def.Keys != "" && def.Secret != "":
+		return nil, fmt.Errorf("only one of keys and secret can be set")
+	case def.Keys != "":
+		var err error
+		if keys, err = ursa.LoadJWTKeys(f.resolve(def.Keys)); err != nil {
+			return nil, err
+		}
+	case def.Secret != "":
+		var err error
+		if keys, err = ursa.HMACJWTKeys([]byte(def.Secret)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("keys or secret is required for RateBys of type jwt")
+	}
+	leeway, err := parseDuration("leeway", def.Leeway)
+	if err != nil {
+		return nil, err
+	}
+	return ursa.NewRateByJWT(ursa.JWTConf{
+		Header:     def.Header,
+		Keys:       keys,
+		Claim:      def.Claim,
+		Algorithms: def.Algorithms,
+		Issuer:     def.Issuer,
+		Audience:   def.Audience,
+		Leeway:     leeway,
+		RequireExp: def.RequireExp,
+		FailCode:   failCode,
+		FailMsg:    def.FailMessage,
+	})
+}
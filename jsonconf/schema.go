@@ -0,0 +1,101 @@
+package jsonconf
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Returns the JSON Schema of configuration files. It is generated from the
+// types the files are decoded into, so it always describes the fields the
+// loader knows about. schema.json holds its output, run go generate to update
+// it.
+func Schema() ([]byte, error) {
+	b := &schemaBuilder{defs: make(map[string]any), building: make(map[reflect.Type]bool)}
+	s := b.schemaOf(reflect.TypeOf(file{}))
+	if len(b.defs) > 0 {
+		s["$defs"] = b.defs
+	}
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "ursa configuration"
+	return json.MarshalIndent(s, "", "  ")
+}
+
+type schemaBuilder struct {
+	defs     map[string]any        // Schemas of the types that contain themselves, by name
+	building map[reflect.Type]bool // Structs whose schema is being built
+}
+
+// Returns the schema of values of the type. Structs that contain themselves,
+// like groups, are put in $defs and referred to.
+func (b *schemaBuilder) schemaOf(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schemaOf(t.Elem())
+		// Only pointers to strings stand for values that can be null
+		if t.Elem().Kind() == reflect.String {
+			s["type"] = []string{"string", "null"}
+		}
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/$defs/" + t.Name()}
+		if b.building[t] {
+			b.defs[t.Name()] = nil
+			return ref
+		}
+		b.building[t] = true
+		defer delete(b.building, t)
+		props := make(map[string]any)
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			// Fields of embedded structs are decoded as if they were fields
+			// of the struct
+			if field.Anonymous && name == "" {
+				embedded := b.schemaOf(field.Type)
+				for name, s := range embedded["properties"].(map[string]any) {
+					props[name] = s
+				}
+				if req, ok := embedded["required"].([]string); ok {
+					required = append(required, req...)
+				}
+				continue
+			}
+			if name == "" || name == "-" {
+				continue
+			}
+			s := b.schemaOf(field.Type)
+			if doc := field.Tag.Get("doc"); doc != "" {
+				s["description"] = doc
+			}
+			if enum := field.Tag.Get("enum"); enum != "" {
+				s["enum"] = strings.Split(enum, ",")
+			}
+			props[name] = s
+			if field.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		if _, ok := b.defs[t.Name()]; ok {
+			b.defs[t.Name()] = s
+			return ref
+		}
+		return s
+	}
+	panic("jsonconf: no schema for type " + t.String())
+}
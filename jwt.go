@@ -0,0 +1,473 @@
+package ursa
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Algorithms supported for verifying JWT signatures
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Configuration to provide when creating a RateBy using [ursa.NewRateByJWT]
+//
+// Header is the header field that holds the token. It defaults to
+// Authorization. The "Bearer " prefix of the value, if present, is ignored.
+// Values with another scheme, like "Basic ...", are left to the other
+// RateBys of the route.
+//
+// Name is the name of the RateBy, which tells apart the signatures and
+// overrides of different RateBys. It defaults to "jwt:" followed by Header
+// and Claim, like "jwt:Authorization:sub". Set it when two RateBys read the
+// same claim from the same header, for example with keys of different
+// issuers.
+//
+// Keys are the keys the signature of the token is verified with. See
+// [ursa.LoadJWTKeys] and [ursa.HMACJWTKeys]
+//
+// Claim is the claim of the token that identifies the client, for example
+// "sub" or "org_id". It defaults to "sub". Since the claim is used as the
+// signature rather than the token itself, a client keeps using the same
+// bucket when its token is rotated.
+//
+// Algorithms lists the algorithms that are accepted. It defaults to HS256,
+// RS256 and ES256. A token is only verified with the keys of the kind the
+// algorithm in its header calls for.
+//
+// Issuer and Audience, when set, must match the iss and aud claims of the
+// token. Leeway is the clock skew allowed when checking exp and nbf claims.
+// If RequireExp is true, tokens without an exp claim are rejected.
+//
+// FailCode and FailMsg are used to respond to requests with an invalid token.
+// FailCode defaults to 401 Unauthorized.
+type JWTConf struct {
+	Header     string
+	Name       string
+	Keys       *JWTKeys
+	Claim      string
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	Leeway     time.Duration
+	RequireExp bool
+	FailCode   int
+	FailMsg    string
+}
+
+// A set of keys used to verify JWT signatures
+type JWTKeys struct {
+	keys []jwtKey
+}
+
+type jwtKey struct {
+	id  string // kid, may be empty
+	key any    // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+type jwtVerifier struct {
+	header     string
+	keys       *JWTKeys
+	claim      string
+	algorithms map[string]bool
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	requireExp bool
+}
+
+// Create a RateBy that performs rate limiting by a claim of a verified JWT.
+// Requests without the token are left to the other RateBys of the route.
+// Requests with a token that isn't properly signed, has expired, isn't valid
+// yet, or lacks the claim are responded with FailCode and FailMsg.
+func NewRateByJWT(conf JWTConf) (*RateBy, error) {
+	if conf.Keys == nil || len(conf.Keys.keys) == 0 {
+		return nil, errors.New("jwt: no keys to verify tokens with")
+	}
+	for _, k := range conf.Keys.keys {
+		if secret, ok := k.key.([]byte); ok && len(secret) == 0 {
+			return nil, errors.New("jwt: empty secret")
+		}
+	}
+	v := &jwtVerifier{
+		header:     conf.Header,
+		keys:       conf.Keys,
+		claim:      conf.Claim,
+		algorithms: make(map[string]bool),
+		issuer:     conf.Issuer,
+		audience:   conf.Audience,
+		leeway:     conf.Leeway,
+		requireExp: conf.RequireExp,
+	}
+	if v.header == "" {
+		v.header = "Authorization"
+	}
+	if v.claim == "" {
+		v.claim = "sub"
+	}
+	algs := conf.Algorithms
+	if len(algs) == 0 {
+		algs = []string{HS256, RS256, ES256}
+	}
+	for _, alg := range algs {
+		if alg != HS256 && alg != RS256 && alg != ES256 {
+			return nil, fmt.Errorf("jwt: unsupported algorithm %q", alg)
+		}
+		v.algorithms[alg] = true
+	}
+	name := conf.Name
+	if name == "" {
+		name = "jwt:" + v.header + ":" + v.claim
+	}
+	failCode := conf.FailCode
+	if failCode == 0 {
+		failCode = http.StatusUnauthorized
+	}
+	return NewRateByExtractor(name, v, failCode, conf.FailMsg), nil
+}
+
+func (v *jwtVerifier) Extract(_ context.Context, r *http.Request) (string, error) {
+	token := r.Header.Get(v.header)
+	if token == "" {
+		return "", ErrNoValue
+	}
+	token, ok := bearerToken(token)
+	if !ok {
+		return "", ErrNoValue
+	}
+	claims, err := v.verify(token, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("jwt: %v: %w", err, ErrInvalidValue)
+	}
+	sig, ok := claimString(claims[v.claim])
+	if !ok || sig == "" {
+		return "", fmt.Errorf("jwt: claim %v missing: %w", v.claim, ErrInvalidValue)
+	}
+	return sig, nil
+}
+
+// Verifies the signature of the token and its time based claims and returns
+// the claims of the token.
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("algorithm %q not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.keys.keys {
+		if header.Kid != "" && k.id != "" && k.id != header.Kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	exp, hasExp := claimTime(claims["exp"])
+	if hasExp && !now.Before(exp.Add(v.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if !hasExp && v.requireExp {
+		return nil, errors.New("token has no expiry")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(v.leeway).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.issuer != "" {
+		if iss, _ := claimString(claims["iss"]); iss != v.issuer {
+			return nil, errors.New("unexpected issuer")
+		}
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+// Checks if sig is a valid signature of signed by key using the algorithm alg.
+// Only the kind of key that the algorithm calls for is accepted. For example,
+// an RSA public key is never used as HMAC secret.
+func verifyJWTSignature(alg string, key any, signed, sig []byte) bool {
+	hash := sha256.Sum256(signed)
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case RS256:
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+	case ES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, hash[:], r, s)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// Returns the claim as a string if it's a string or a number
+func claimString(c any) (string, bool) {
+	switch v := c.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// Returns the time represented by a NumericDate claim like exp and nbf
+func claimTime(c any) (time.Time, bool) {
+	n, ok := c.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*float64(time.Second))), true
+}
+
+// Returns the token in a header value that either has the Bearer scheme or
+// no scheme at all, or false if it has another scheme, like Basic
+func bearerToken(value string) (string, bool) {
+	scheme, rest, ok := strings.Cut(value, " ")
+	if !ok {
+		return value, true
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// The aud claim can either be a string or an array of strings
+func hasAudience(aud any, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []any:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Create a key set with a single secret for verifying HS256 tokens. The
+// secret can't be empty.
+func HMACJWTKeys(secret []byte) (*JWTKeys, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("jwt: empty secret")
+	}
+	return &JWTKeys{keys: []jwtKey{{key: secret}}}, nil
+}
+
+// Load keys for verifying JWTs from the file at path. See [ursa.ParseJWTKeys]
+// for the supported formats.
+func LoadJWTKeys(path string) (*JWTKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWTKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return keys, nil
+}
+
+// Parse keys for verifying JWTs. The data may either be a JWKS document, that
+// is a JSON object with the "keys" array of JSON Web Keys, or one or more PEM
+// encoded public keys or certificates.
+//
+// RSA keys, EC keys on the P-256 curve and symmetric (oct) keys of a JWKS
+// document are supported. Keys whose use isn't "sig" are skipped.
+func ParseJWTKeys(data []byte) (*JWTKeys, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		return parseJWKS([]byte(trimmed))
+	}
+	keys := &JWTKeys{}
+	rest := []byte(trimmed)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		var key any
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys.keys = append(keys.keys, jwtKey{key: key})
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+// A JSON Web Key as described in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (*JWTKeys, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := &JWTKeys{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", i, err)
+		}
+		keys.keys = append(keys.keys, jwtKey{id: k.Kid, key: key})
+	}
+	if len(keys.keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "oct":
+		return b64.DecodeString(k.K)
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid point")
+		}
+		// Parsing the uncompressed point checks that it's on the curve
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,198 @@
+package ursa
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a signed JWT with given header and claims
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(header) + "." + enc(claims)
+	hash := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTRateBy(t *testing.T) {
+	secret := []byte("very secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherECKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// Write public keys to a PEM file
+	dir := t.TempDir()
+	pemFile := filepath.Join(dir, "keys.pem")
+	var pemData []byte
+	for _, pub := range []any{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+	os.WriteFile(pemFile, pemData, 0o600)
+	pemKeys, err := LoadJWTKeys(pemFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A JWKS document with the same keys
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hs", "k": %q},
+		{"kty": "RSA", "kid": "rs", "n": %q, "e": "AQAB"},
+		{"kty": "EC", "kid": "es", "crv": "P-256", "x": %q, "y": %q}
+	]}`, b64(secret), b64(rsaKey.N.Bytes()), b64(ecKey.X.FillBytes(make([]byte, 32))),
+		b64(ecKey.Y.FillBytes(make([]byte, 32))))
+	jwksKeys, err := ParseJWTKeys([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(sub string, extra ...any) map[string]any {
+		c := map[string]any{"sub": sub, "org_id": "org-" + sub, "exp": now + 60}
+		for i := 0; i+1 < len(extra); i += 2 {
+			c[extra[i].(string)] = extra[i+1]
+		}
+		return c
+	}
+	hs := map[string]any{"alg": HS256, "typ": "JWT"}
+	rs := map[string]any{"alg": RS256, "typ": "JWT"}
+	es := map[string]any{"alg": ES256, "typ": "JWT"}
+	none := map[string]any{"alg": "none", "typ": "JWT"}
+
+	hmacKeys, err := HMACJWTKeys(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		keys   *JWTKeys
+		claim  string
+		token  string
+		auth   string // Authorization header to send instead of the token
+		expSig string
+		expErr error
+	}
+	tests := []test{
+		{keys: hmacKeys, token: "", expErr: ErrNoValue},
+		{keys: hmacKeys, token: signJWT(t, hs, claims("u1"), secret), expSig: "u1"},
+		{keys: hmacKeys, claim: "org_id", token: signJWT(t, hs, claims("u1"), secret), expSig: "org-u1"},
+		{keys: hmacKeys, token: signJWT(t, hs, claims("u1"), []byte("wrong")), expErr: ErrInvalidValue},
+		{keys: hmacKeys, token: signJWT(t, none, claims("u1"), secret), expErr: ErrInvalidValue},
+		{keys: hmacKeys, token: signJWT(t, hs, claims("u1", "exp", now-10), secret), expErr: ErrInvalidValue},
+		{keys: hmacKeys, token: signJWT(t, hs, claims("u1", "nbf", now+60), secret), expErr: ErrInvalidValue},
+		{keys: hmacKeys, claim: "tenant", token: signJWT(t, hs, claims("u1"), secret), expErr: ErrInvalidValue},
+		{keys: hmacKeys, token: "not.a.jwt", expErr: ErrInvalidValue},
+		// Other schemes are left to other RateBys
+		{keys: hmacKeys, auth: "Basic dXNlcjpwYXNz", expErr: ErrNoValue},
+		{keys: hmacKeys, auth: signJWT(t, hs, claims("u1"), secret), expSig: "u1"},
+		{keys: pemKeys, token: signJWT(t, rs, claims("u2"), rsaKey), expSig: "u2"},
+		{keys: pemKeys, token: signJWT(t, es, claims("u3"), ecKey), expSig: "u3"},
+		{keys: pemKeys, token: signJWT(t, es, claims("u3"), otherECKey), expErr: ErrInvalidValue},
+		// HMAC tokens signed with a public key as secret must be rejected
+		{keys: pemKeys, token: signJWT(t, hs, claims("u1"), pemData), expErr: ErrInvalidValue},
+		{keys: jwksKeys, token: signJWT(t, map[string]any{"alg": HS256, "kid": "hs"}, claims("u4"), secret), expSig: "u4"},
+		{keys: jwksKeys, token: signJWT(t, map[string]any{"alg": RS256, "kid": "rs"}, claims("u5"), rsaKey), expSig: "u5"},
+		{keys: jwksKeys, token: signJWT(t, map[string]any{"alg": ES256, "kid": "es"}, claims("u6"), ecKey), expSig: "u6"},
+		{keys: jwksKeys, token: signJWT(t, map[string]any{"alg": RS256, "kid": "es"}, claims("u5"), rsaKey), expErr: ErrInvalidValue},
+	}
+	for i, test := range tests {
+		by, err := NewRateByJWT(JWTConf{Keys: test.keys, Claim: test.claim, FailCode: 401})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := http.NewRequest("GET", "https://example.com/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		sig, err := by.Extract(context.Background(), r)
+		if !errors.Is(err, test.expErr) || (test.expErr == nil && err != nil) {
+			t.Errorf("case %d: expected error %v got %v", i, test.expErr, err)
+		}
+		if sig != test.expSig {
+			t.Errorf("case %d: expected signature %q got %q", i, test.expSig, sig)
+		}
+	}
+}
+
+func TestJWTConf(t *testing.T) {
+	if _, err := HMACJWTKeys(nil); err == nil {
+		t.Error("expected an error for an empty secret")
+	}
+	empty, err := ParseJWTKeys([]byte(`{"keys": [{"kty": "oct", "k": ""}]}`))
+	if err == nil {
+		if _, err := NewRateByJWT(JWTConf{Keys: empty}); err == nil {
+			t.Error("expected an error for an empty secret in a JWKS")
+		}
+	}
+
+	keys, _ := HMACJWTKeys([]byte("secret"))
+	type test struct {
+		conf        JWTConf
+		expName     string
+		expFailCode int
+	}
+	tests := []test{
+		{JWTConf{Keys: keys}, "jwt:Authorization:sub", 401},
+		{JWTConf{Keys: keys, Header: "X-Token", Claim: "org_id", FailCode: 403}, "jwt:X-Token:org_id", 403},
+		{JWTConf{Keys: keys, Name: "partner-jwt"}, "partner-jwt", 401},
+	}
+	for i, test := range tests {
+		by, err := NewRateByJWT(test.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if by.Name != test.expName {
+			t.Errorf("case %d: expected name %v got %v", i, test.expName, by.Name)
+		}
+		if by.FailCode != test.expFailCode {
+			t.Errorf("case %d: expected fail code %v got %v", i, test.expFailCode, by.FailCode)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package ursa
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Kinds of problems found by [ursa.Lint]
+type LintCheck string
+
+const (
+	// The pattern isn't anchored at the start with ^, so it matches the
+	// path anywhere. For example "/users" matches "/admin/users".
+	LintUnanchored LintCheck = "unanchored"
+	// Every request the route matches seems to be matched by an earlier
+	// route, so the route is never used.
+	LintShadowed LintCheck = "shadowed"
+	// The route has the same template or pattern, host and conditions as an
+	// earlier route, so requests to both routes use the same buckets.
+	LintSharedBucket LintCheck = "shared-bucket"
+	// A RateBy has different rates on routes that share buckets, so the
+	// buckets are resized back and forth.
+	LintConflictingRates LintCheck = "conflicting-rates"
+)
+
+// A LintWarning is something in a configuration that is likely a mistake,
+// even though the configuration is valid
+type LintWarning struct {
+	Check LintCheck
+	Route int // Index of the route with the problem, in the order routes are matched
+	Other int // Index of the earlier route involved, -1 if none
+	Msg   string
+}
+
+func (w LintWarning) String() string {
+	return fmt.Sprintf("route %d: %v: %v", w.Route, w.Check, w.Msg)
+}
+
+// Maximum number of paths sampled from a pattern when looking for shadowed
+// routes
+const maxLintSamples = 64
+
+// Looks for routes that are likely mistakes in a valid configuration, like
+// routes that can never be reached because the routes before them match
+// every request they do. The server logs the warnings when it's created or
+// reloaded. Routes are numbered in the order they are matched, so when there
+// are Groups, the routes of the groups are numbered first.
+//
+// Whether a route is shadowed is decided by sampling paths from its pattern,
+// so a route is reported only if every sampled path matches the earlier
+// route. The check can miss shadowed routes, but rarely reports ones that
+// aren't.
+func Lint(conf Conf) []LintWarning {
+	var warnings []LintWarning
+	warn := func(check LintCheck, route, other int, format string, args ...any) {
+		warnings = append(warnings, LintWarning{check, route, other, fmt.Sprintf(format, args...)})
+	}
+	routes := flatRoutes(conf)
+	patterns := make([]*regexp.Regexp, len(routes))
+	methods := make([]methodSet, len(routes))
+	for i := range routes {
+		patterns[i] = routePattern(&routes[i])
+		methods[i], _ = newMethodSet(routes[i].Methods, conf.CustomMethods)
+	}
+	for j := range routes {
+		r := &routes[j]
+		if patterns[j] == nil {
+			continue
+		}
+		if r.Template == "" && !anchoredAtStart(patterns[j]) {
+			warn(LintUnanchored, j, -1, "pattern %q isn't anchored with ^ so it matches the path anywhere", patterns[j])
+		}
+		paths := samplePaths(patterns[j])
+		for i := 0; i < j; i++ {
+			if patterns[i] == nil {
+				continue
+			}
+			earlier := &routes[i]
+			if covers(earlier, r, methods[i], methods[j]) && allMatch(patterns[i], paths) {
+				warn(LintShadowed, j, i, "every request it matches seems to be matched by route %d first", i)
+				break
+			}
+			if routeId(earlier) != routeId(r) {
+				continue
+			}
+			warn(LintSharedBucket, j, i, "has the same path, host and conditions as route %d so they share buckets", i)
+			for by, rate := range r.Rates {
+				if other, ok := earlier.Rates[by]; ok && other != rate {
+					warn(LintConflictingRates, j, i, "RateBy %q has rate %v but route %d has %v for the same buckets", by.source(), rate, i, other)
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// Returns the pattern the route is matched with, or nil if it has none
+func routePattern(r *Route) *regexp.Regexp {
+	if r.Template != "" {
+		pattern, _ := templateRegexp(r.Template)
+		return pattern
+	}
+	return r.Pattern
+}
+
+// Returns whether the pattern only matches at the start of the path, or
+// matches the same as if it did
+func anchoredAtStart(pattern *regexp.Regexp) bool {
+	re, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return false
+	}
+	for re.Op == syntax.OpConcat || re.Op == syntax.OpCapture {
+		if len(re.Sub) == 0 {
+			return false
+		}
+		re = re.Sub[0]
+	}
+	switch re.Op {
+	case syntax.OpBeginText, syntax.OpBeginLine:
+		return true
+	case syntax.OpStar:
+		// Patterns starting with .* match the same with or without ^
+		return re.Sub[0].Op == syntax.OpAnyChar || re.Sub[0].Op == syntax.OpAnyCharNotNL
+	}
+	return false
+}
+
+// Returns whether the earlier route matches every request the later one does
+// as far as methods, host and conditions on the request go
+func covers(earlier, later *Route, earlierMethods, laterMethods methodSet) bool {
+	if !earlierMethods.any {
+		if laterMethods.any {
+			return false
+		}
+		for m := range laterMethods.names {
+			if !earlierMethods.names[m] {
+				return false
+			}
+		}
+	}
+	if earlier.hasRequestConditions() && conditionsKey(earlier) != conditionsKey(later) {
+		return false
+	}
+	return hostCovers(earlier.Host, later.Host)
+}
+
+// Returns whether Host of a route matches every host Host of another route
+// matches
+func hostCovers(host, other string) bool {
+	host, other = strings.ToLower(host), strings.ToLower(other)
+	switch {
+	case host == "" || host == other:
+		return true
+	case other == "":
+		return false
+	case strings.HasPrefix(other, "*."):
+		return hostMatches(host, other[2:]) && strings.HasPrefix(host, "*.")
+	}
+	return hostMatches(host, other)
+}
+
+func allMatch(pattern *regexp.Regexp, paths []string) bool {
+	for _, p := range paths {
+		if !pattern.MatchString(p) {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
+
+// Returns paths that the pattern matches. Besides the shortest strings the
+// pattern matches, they include strings with more repetitions and other
+// characters of character classes, as well as the strings surrounded by
+// other segments where the pattern allows it.
+func samplePaths(pattern *regexp.Regexp) []string {
+	re, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, s := range samples(re.Simplify()) {
+		for _, p := range []string{s, "/x" + s, s + "/x", s + "x"} {
+			if strings.HasPrefix(p, "/") && pattern.MatchString(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// Returns some of the strings the regex matches, at most maxLintSamples
+func samples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return nil
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		return classSamples(re.Rune)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"x", "/"}
+	case syntax.OpCapture:
+		return samples(re.Sub[0])
+	case syntax.OpStar:
+		return repeatSamples(re.Sub[0], 0, 2)
+	case syntax.OpPlus:
+		return repeatSamples(re.Sub[0], 1, 2)
+	case syntax.OpQuest:
+		return repeatSamples(re.Sub[0], 0, 1)
+	case syntax.OpRepeat:
+		high := re.Max
+		if high < 0 || high > re.Min+1 {
+			high = re.Min + 1
+		}
+		return repeatSamples(re.Sub[0], re.Min, high)
+	case syntax.OpConcat:
+		result := []string{""}
+		for _, sub := range re.Sub {
+			result = concatSamples(result, samples(sub))
+		}
+		return result
+	case syntax.OpAlternate:
+		var result []string
+		for _, sub := range re.Sub {
+			result = append(result, samples(sub)...)
+		}
+		return result[:min(len(result), maxLintSamples)]
+	}
+	// Assertions like ^, $ and \b match the empty string
+	return []string{""}
+}
+
+// Returns the first and last printable characters of the class, which is
+// given as pairs of ranges
+func classSamples(ranges []rune) []string {
+	var first, last rune = -1, -1
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := max(ranges[i], '!'), min(ranges[i+1], '~')
+		if lo > hi {
+			continue
+		}
+		if first < 0 {
+			first = lo
+		}
+		last = hi
+	}
+	switch {
+	case first < 0 && len(ranges) > 0:
+		return []string{string(ranges[0])}
+	case first < 0:
+		return nil
+	case first == last:
+		return []string{string(first)}
+	}
+	return []string{string(first), string(last)}
+}
+
+// Returns samples of the regex repeated from low to high times
+func repeatSamples(re *syntax.Regexp, low, high int) []string {
+	sub := samples(re)
+	var result []string
+	for n := low; n <= high; n++ {
+		repeated := []string{""}
+		for i := 0; i < n; i++ {
+			repeated = concatSamples(repeated, sub)
+		}
+		result = append(result, repeated...)
+	}
+	return result[:min(len(result), maxLintSamples)]
+}
+
+// Returns each of a followed by each of b
+func concatSamples(a, b []string) []string {
+	var result []string
+	for _, x := range a {
+		for _, y := range b {
+			if len(result) == maxLintSamples {
+				return result
+			}
+			result = append(result, x+y)
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package ursa
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	rates := RouteRates{RateByIP: NewRate(10, Hour)}
+	route := func(methods []string, pattern string) Route {
+		return Route{Methods: methods, Pattern: regexp.MustCompile(pattern), Rates: rates}
+	}
+	get := []string{"GET"}
+	type warning struct {
+		check        LintCheck
+		route, other int
+	}
+	type test struct {
+		routes      []Route
+		expWarnings []warning
+		description string
+	}
+	tests := []test{
+		{
+			routes:      []Route{route(get, "/"), route(get, "^/api")},
+			expWarnings: []warning{{LintUnanchored, 0, -1}, {LintShadowed, 1, 0}},
+			description: "catch all before other routes",
+		},
+		{
+			routes:      []Route{route(get, ".*"), route(get, "^/api$")},
+			expWarnings: []warning{{LintShadowed, 1, 0}},
+			description: ".* needs no anchor",
+		},
+		{
+			routes:      []Route{route(get, "^/api/"), route(get, "^/api/v1/")},
+			expWarnings: []warning{{LintShadowed, 1, 0}},
+			description: "prefix before longer prefix",
+		},
+		{
+			routes:      []Route{route(get, "^/api/v1/"), route(get, "^/api/")},
+			description: "longer prefix before prefix",
+		},
+		{
+			routes:      []Route{route([]string{"GET", "POST"}, "^/api/"), route(get, "^/api/users$")},
+			expWarnings: []warning{{LintShadowed, 1, 0}},
+			description: "more methods before fewer",
+		},
+		{
+			routes:      []Route{route(get, "^/api/"), route([]string{AnyMethod}, "^/api/users$")},
+			description: "fewer methods before more",
+		},
+		{
+			routes:      []Route{{Methods: get, Template: "/users/{id}", Rates: rates}, route(get, "^/users/[0-9]+$")},
+			expWarnings: []warning{{LintShadowed, 1, 0}},
+			description: "template before narrower pattern",
+		},
+		{
+			routes:      []Route{route(get, "^/users/[0-9]+$"), {Methods: get, Template: "/users/{id}", Rates: rates}},
+			description: "pattern before wider template",
+		},
+		{
+			routes:      []Route{route(get, "^/(a|b)$"), route(get, "^/(a|b|c)$")},
+			description: "alternation with more choices",
+		},
+		{
+			routes: []Route{
+				{Methods: get, Pattern: regexp.MustCompile("^/"), Host: "*.example.com", Rates: rates},
+				{Methods: get, Pattern: regexp.MustCompile("^/x"), Host: "api.example.com", Rates: rates},
+				{Methods: get, Pattern: regexp.MustCompile("^/x"), Rates: rates},
+			},
+			expWarnings: []warning{{LintShadowed, 1, 0}},
+			description: "wildcard host before subdomain",
+		},
+		{
+			routes: []Route{
+				{Methods: get, Pattern: regexp.MustCompile("^/"), Headers: map[string]*regexp.Regexp{"X-Beta": nil}, Rates: rates},
+				route(get, "^/x"),
+			},
+			description: "route with conditions before route without",
+		},
+		{
+			routes:      []Route{route(get, "^/a$"), route([]string{"POST"}, "^/a$")},
+			expWarnings: []warning{{LintSharedBucket, 1, 0}},
+			description: "same pattern for different methods",
+		},
+		{
+			routes: []Route{
+				route(get, "^/a$"),
+				{Methods: []string{"POST"}, Pattern: regexp.MustCompile("^/a$"), Rates: RouteRates{RateByIP: NewRate(5, Hour)}},
+			},
+			expWarnings: []warning{{LintSharedBucket, 1, 0}, {LintConflictingRates, 1, 0}},
+			description: "same pattern with different rates",
+		},
+	}
+	for _, test := range tests {
+		warnings := Lint(Conf{Upstream: upstream(), Routes: test.routes})
+		if len(warnings) != len(test.expWarnings) {
+			t.Errorf("case %v: expected %v warnings got %v", test.description, len(test.expWarnings), warnings)
+			continue
+		}
+		for i, exp := range test.expWarnings {
+			w := warnings[i]
+			if w.Check != exp.check || w.Route != exp.route || w.Other != exp.other {
+				t.Errorf("case %v: expected %v of route %v by %v got %v", test.description, exp.check, exp.route, exp.other, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package memoize
+
+import (
+	"container/list"
+	"sync"
+)
+
+type boundedEntry[K comparable, V any] struct {
+	arg K
+	val V
+}
+
+// Memoize a unary function remembering at most size results.
+//
+// Unlike [memoize.Unary], whose cache grows with every distinct argument, the
+// function returned by Bounded forgets the least recently used result once
+// size results are remembered. This makes it suitable for memoizing functions
+// of arguments controlled by others, like the path of a request, where a flood
+// of distinct arguments would otherwise grow the cache without limit.
+//
+// If size is less than 1, the cache holds a single result.
+//
+// The function returned by Bounded is safe for concurrent use.
+func Bounded[K comparable, V any](fn func(K) V, size int) func(K) V {
+	if size < 1 {
+		size = 1
+	}
+	cache := make(map[K]*list.Element, size)
+	order := list.New() // Most recently used at the front
+	var mu sync.Mutex
+	return func(arg K) V {
+		mu.Lock()
+		if e, ok := cache[arg]; ok {
+			order.MoveToFront(e)
+			val := e.Value.(*boundedEntry[K, V]).val
+			mu.Unlock()
+			return val
+		}
+		mu.Unlock()
+
+		// fn is called without holding the lock so that a slow call doesn't
+		// block calls with other arguments
+		val := fn(arg)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if e, ok := cache[arg]; ok {
+			// Another call added the result meanwhile
+			order.MoveToFront(e)
+			return val
+		}
+		cache[arg] = order.PushFront(&boundedEntry[K, V]{arg, val})
+		if order.Len() > size {
+			oldest := order.Back()
+			order.Remove(oldest)
+			delete(cache, oldest.Value.(*boundedEntry[K, V]).arg)
+		}
+		return val
+	}
+}
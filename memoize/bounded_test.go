@@ -0,0 +1,59 @@
+package memoize
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBounded(t *testing.T) {
+	callCounts := 0
+	double := func(n int) int {
+		callCounts++
+		return n * 2
+	}
+	cachedDouble := Bounded(double, 2)
+	tests := []struct {
+		n                  int
+		expectedResult     int
+		expectedCallCounts int
+	}{
+		{n: 1, expectedResult: 2, expectedCallCounts: 1},
+		{n: 1, expectedResult: 2, expectedCallCounts: 1},
+		{n: 2, expectedResult: 4, expectedCallCounts: 2},
+		// 1 is used more recently than 2
+		{n: 1, expectedResult: 2, expectedCallCounts: 2},
+		// 3 evicts 2, the least recently used
+		{n: 3, expectedResult: 6, expectedCallCounts: 3},
+		{n: 1, expectedResult: 2, expectedCallCounts: 3},
+		{n: 2, expectedResult: 4, expectedCallCounts: 4},
+	}
+	for _, test := range tests {
+		got := cachedDouble(test.n)
+		if got != test.expectedResult {
+			t.Errorf("expected %v, got %v", test.expectedResult, got)
+		}
+		if callCounts != test.expectedCallCounts {
+			t.Errorf("expected call counts: %v, is %v", test.expectedCallCounts, callCounts)
+		}
+	}
+}
+
+func TestBoundedStaysBounded(t *testing.T) {
+	size := 100
+	calls := 0
+	cached := Bounded(func(s string) int { calls++; return len(s) }, size)
+	for i := 0; i < 10*size; i++ {
+		cached(fmt.Sprintf("/random/%d", i))
+	}
+	// Only the results of the last size calls are remembered
+	for i := 9 * size; i < 10*size; i++ {
+		cached(fmt.Sprintf("/random/%d", i))
+	}
+	if calls != 10*size {
+		t.Errorf("expected %v calls got %v", 10*size, calls)
+	}
+	cached("/random/0")
+	if calls != 10*size+1 {
+		t.Errorf("expected the oldest result to be forgotten")
+	}
+}
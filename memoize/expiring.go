@@ -0,0 +1,125 @@
+package memoize
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Longest a call to the memoized function may take when the context of the
+// call that made it has no deadline. See [memoize.Expiring]
+const ExpiringCallTimeout = time.Minute
+
+type expiringEntry[V any] struct {
+	val     V
+	err     error
+	expires time.Time
+	done    chan struct{} // Closed once val and err are set
+}
+
+// Memoize a unary function that takes a context and may return an error,
+// for example a function that looks up a token in a database.
+//
+// Unlike [memoize.Unary], results are only kept for as long as the ttl function
+// says. ttl is called with the result of each call to fn. If it returns a
+// duration <= 0, the result isn't cached. This allows, for example, to cache
+// successful results for longer than the failed ones, or not cache errors
+// caused by a network failure at all.
+//
+// Concurrent calls with the same argument are deduplicated: only one of them
+// calls fn and the rest wait for its result. Any call returns early with the
+// error of its context if the context is done before the result is available.
+// As the result is shared, fn isn't called with the context of the call that
+// made it but with one that isn't cancelled along with it. It keeps the values
+// and the deadline of that context, or has a deadline of
+// [memoize.ExpiringCallTimeout] if that context has none.
+//
+// The function returned by Expiring is safe for concurrent use.
+func Expiring[K comparable, V any](
+	fn func(context.Context, K) (V, error),
+	ttl func(V, error) time.Duration,
+) func(context.Context, K) (V, error) {
+	cache := make(map[K]*expiringEntry[V])
+	insertsSinceSweep := 0
+	var mu sync.Mutex
+
+	// Removes the entries that have expired. Must be called with mu held.
+	sweep := func(now time.Time) {
+		for k, e := range cache {
+			if isDone(e.done) && now.After(e.expires) {
+				delete(cache, k)
+			}
+		}
+		insertsSinceSweep = 0
+	}
+
+	return func(ctx context.Context, arg K) (V, error) {
+		now := time.Now()
+		mu.Lock()
+		e, ok := cache[arg]
+		if ok && isDone(e.done) && now.After(e.expires) {
+			delete(cache, arg)
+			ok = false
+		}
+		if ok {
+			mu.Unlock()
+			select {
+			case <-e.done:
+				return e.val, e.err
+			case <-ctx.Done():
+				var zero V
+				return zero, ctx.Err()
+			}
+		}
+		e = &expiringEntry[V]{done: make(chan struct{})}
+		cache[arg] = e
+		// Sweeping once the number of inserts catches up with the size of
+		// the cache keeps the cost of sweeping constant per call on average.
+		insertsSinceSweep++
+		if insertsSinceSweep >= len(cache) {
+			sweep(now)
+		}
+		mu.Unlock()
+
+		go func() {
+			callCtx, cancel := detach(ctx)
+			defer cancel()
+			val, err := fn(callCtx, arg)
+			d := ttl(val, err)
+			mu.Lock()
+			e.val, e.err = val, err
+			e.expires = time.Now().Add(d)
+			close(e.done)
+			if d <= 0 && cache[arg] == e {
+				delete(cache, arg)
+			}
+			mu.Unlock()
+		}()
+		select {
+		case <-e.done:
+			return e.val, e.err
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// Returns a context with the values and the deadline of ctx that isn't
+// cancelled when ctx is
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(ExpiringCallTimeout)
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+}
+
+func isDone(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
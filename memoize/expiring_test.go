@@ -0,0 +1,134 @@
+package memoize
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiring(t *testing.T) {
+	var callCounts atomic.Int32
+	errOdd := errors.New("odd")
+	half := func(_ context.Context, n int) (int, error) {
+		callCounts.Add(1)
+		if n%2 == 1 {
+			return 0, errOdd
+		}
+		return n / 2, nil
+	}
+	ttl := func(_ int, err error) time.Duration {
+		if err != nil {
+			return 0 // Don't cache errors
+		}
+		return 50 * time.Millisecond
+	}
+	cachedHalf := Expiring(half, ttl)
+	ctx := context.Background()
+
+	tests := []struct {
+		n                  int
+		sleep              time.Duration
+		expectedResult     int
+		expectedErr        error
+		expectedCallCounts int32
+	}{
+		{n: 4, expectedResult: 2, expectedCallCounts: 1},
+		{n: 4, expectedResult: 2, expectedCallCounts: 1},
+		{n: 3, expectedErr: errOdd, expectedCallCounts: 2},
+		{n: 3, expectedErr: errOdd, expectedCallCounts: 3},
+		{n: 4, sleep: 60 * time.Millisecond, expectedResult: 2, expectedCallCounts: 4},
+		{n: 4, expectedResult: 2, expectedCallCounts: 4},
+	}
+	for _, test := range tests {
+		time.Sleep(test.sleep)
+		got, err := cachedHalf(ctx, test.n)
+		if got != test.expectedResult || err != test.expectedErr {
+			t.Errorf("expected %v, %v got %v, %v", test.expectedResult, test.expectedErr, got, err)
+		}
+		if c := callCounts.Load(); c != test.expectedCallCounts {
+			t.Errorf("expected call counts: %v, is %v", test.expectedCallCounts, c)
+		}
+	}
+}
+
+func TestExpiringDeduplicates(t *testing.T) {
+	var callCounts atomic.Int32
+	release := make(chan struct{})
+	slow := func(_ context.Context, s string) (string, error) {
+		callCounts.Add(1)
+		<-release
+		return s, nil
+	}
+	cachedSlow := Expiring(slow, func(string, error) time.Duration { return time.Minute })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, _ := cachedSlow(context.Background(), "a"); got != "a" {
+				t.Errorf("expected a got %v", got)
+			}
+		}()
+	}
+	// Give the goroutines time to wait for the first call
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if c := callCounts.Load(); c != 1 {
+		t.Errorf("expected concurrent calls to be deduplicated into 1 call, got %v calls", c)
+	}
+
+	// A waiting call gives up when its context is done
+	block := Expiring(func(context.Context, int) (int, error) {
+		select {}
+	}, func(int, error) time.Duration { return time.Minute })
+	go block(context.Background(), 1)
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := block(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func TestExpiringLeaderCancelled(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(ctx context.Context, s string) (string, error) {
+		select {
+		case <-release:
+			return s, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	cachedSlow := Expiring(slow, func(string, error) time.Duration { return time.Minute })
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := cachedSlow(leaderCtx, "a")
+		leaderErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	followerResult := make(chan string)
+	go func() {
+		got, err := cachedSlow(context.Background(), "a")
+		if err != nil {
+			t.Errorf("expected no error for the waiting call got %v", err)
+		}
+		followerResult <- got
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled call to return context.Canceled got %v", err)
+	}
+	close(release)
+	if got := <-followerResult; got != "a" {
+		t.Errorf("expected the waiting call to get a got %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package ursa
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Entries of Methods of [ursa.Route] that stand for more than one method.
+// Like method names, they are case insensitive.
+const (
+	AnyMethod       = "ANY"      // Every method. "*" means the same
+	SafeMethods     = "safe"     // GET, HEAD and OPTIONS
+	MutatingMethods = "mutating" // POST, PUT, PATCH and DELETE
+)
+
+var methodGroups = map[string][]string{
+	strings.ToUpper(SafeMethods):     {http.MethodGet, http.MethodHead, http.MethodOptions},
+	strings.ToUpper(MutatingMethods): {http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+}
+
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// The methods a route matches
+type methodSet struct {
+	any   bool
+	names map[string]bool
+}
+
+func (m methodSet) contains(method string) bool {
+	return m.any || m.names[strings.ToUpper(method)]
+}
+
+// Returns the set of methods described by the Methods of a route. Returns an
+// error if an entry isn't a standard method, a method group, a wildcard or one
+// of custom, or if a method is included more than once.
+func newMethodSet(methods []string, custom []string) (methodSet, error) {
+	set := methodSet{names: make(map[string]bool)}
+	known := make(map[string]bool)
+	for _, m := range standardMethods {
+		known[m] = true
+	}
+	for _, m := range custom {
+		known[strings.ToUpper(m)] = true
+	}
+	add := func(entry, method string) error {
+		if set.names[method] {
+			return fmt.Errorf("method %v in %q is listed more than once", method, entry)
+		}
+		set.names[method] = true
+		return nil
+	}
+	for _, entry := range methods {
+		upper := strings.ToUpper(entry)
+		switch {
+		case upper == AnyMethod || upper == "*":
+			if len(methods) > 1 {
+				return set, fmt.Errorf("%q can't be combined with other methods", entry)
+			}
+			set.any = true
+		case methodGroups[upper] != nil:
+			for _, m := range methodGroups[upper] {
+				if err := add(entry, m); err != nil {
+					return set, err
+				}
+			}
+		case known[upper]:
+			if err := add(entry, upper); err != nil {
+				return set, err
+			}
+		default:
+			return set, fmt.Errorf("unknown method %q, see CustomMethods of ursa.Conf", entry)
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,50 @@
+package ursa
+
+import "testing"
+
+func TestMethodSet(t *testing.T) {
+	type test struct {
+		methods  []string
+		custom   []string
+		method   string
+		expMatch bool
+		isErr    bool
+	}
+	tests := []test{
+		{methods: []string{"GET"}, method: "GET", expMatch: true},
+		{methods: []string{"get"}, method: "GET", expMatch: true},
+		{methods: []string{"GET"}, method: "get", expMatch: true},
+		{methods: []string{"GET"}, method: "POST", expMatch: false},
+		{methods: []string{"ANY"}, method: "PURGE", expMatch: true},
+		{methods: []string{"*"}, method: "DELETE", expMatch: true},
+		{methods: []string{"safe"}, method: "HEAD", expMatch: true},
+		{methods: []string{"SAFE"}, method: "OPTIONS", expMatch: true},
+		{methods: []string{"safe"}, method: "POST", expMatch: false},
+		{methods: []string{"mutating"}, method: "PATCH", expMatch: true},
+		{methods: []string{"mutating"}, method: "GET", expMatch: false},
+		{methods: []string{"safe", "POST"}, method: "POST", expMatch: true},
+		{methods: []string{"purge"}, custom: []string{"PURGE"}, method: "PURGE", expMatch: true},
+		{methods: []string{"PURGE"}, isErr: true},
+		{methods: []string{"GETT"}, isErr: true},
+		{methods: []string{"GET", "get"}, isErr: true},
+		{methods: []string{"safe", "HEAD"}, isErr: true},
+		{methods: []string{"ANY", "GET"}, isErr: true},
+		{methods: []string{"*", "*"}, isErr: true},
+	}
+	for _, test := range tests {
+		set, err := newMethodSet(test.methods, test.custom)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("%v: expected error", test.methods)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: expected no error got %v", test.methods, err)
+			continue
+		}
+		if got := set.contains(test.method); got != test.expMatch {
+			t.Errorf("%v contains %v: expected %v got %v", test.methods, test.method, test.expMatch, got)
+		}
+	}
+}
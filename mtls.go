@@ -0,0 +1,120 @@
+package ursa
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// CertIdentity describes which part of a client certificate identifies the
+// client when rate limiting by client certificates. See
+// [ursa.NewRateByClientCert]
+type CertIdentity int
+
+const (
+	// The subject distinguished name, e.g. "CN=client,O=Acme"
+	CertSubject CertIdentity = iota
+	// The first DNS name in the subject alternative names
+	CertDNSName
+	// The first email address in the subject alternative names
+	CertEmailAddress
+	// The first URI in the subject alternative names, e.g. a SPIFFE ID
+	CertURI
+	// Hex encoded SHA-256 fingerprint of the subject public key info. Unlike
+	// the other identities, it changes when the client's key changes.
+	CertSPKIFingerprint
+)
+
+type clientCertExtractor struct {
+	identity CertIdentity
+}
+
+func (e clientCertExtractor) Extract(_ context.Context, r *http.Request) (string, error) {
+	// Only the certificates that were verified against the client CAs of the
+	// TLS config are trusted. r.TLS.PeerCertificates may hold certificates
+	// that were sent but not verified.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", fmt.Errorf("no verified client certificate: %w", ErrNoValue)
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var sig string
+	switch e.identity {
+	case CertSubject:
+		sig = cert.Subject.String()
+	case CertDNSName:
+		if len(cert.DNSNames) > 0 {
+			sig = cert.DNSNames[0]
+		}
+	case CertEmailAddress:
+		if len(cert.EmailAddresses) > 0 {
+			sig = cert.EmailAddresses[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			sig = cert.URIs[0].String()
+		}
+	case CertSPKIFingerprint:
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		sig = hex.EncodeToString(sum[:])
+	}
+	if sig == "" {
+		return "", fmt.Errorf("client certificate has no identity of kind %d: %w", e.identity, ErrInvalidValue)
+	}
+	return sig, nil
+}
+
+// Create a RateBy that performs rate limiting by the verified certificate that
+// the client presented during TLS handshake. identity tells which part of the
+// certificate is used as the signature. Requests whose certificate lacks the
+// identity are responded with failCode and failMsg. Requests without a
+// verified client certificate are left to the other RateBys of the route, or
+// responded with failCode and failMsg too if the route has no other RateBys.
+//
+// This RateBy only works when ursa terminates TLS itself, as in:
+//
+//	tlsConf, err := ursa.ClientCertTLSConfig("clients-ca.pem")
+//	srv := &http.Server{Addr: ":443", Handler: ursa.New(conf), TLSConfig: tlsConf}
+//	srv.ListenAndServeTLS("server.pem", "server-key.pem")
+func NewRateByClientCert(identity CertIdentity, failCode int, failMsg string) *RateBy {
+	name := fmt.Sprintf("clientcert:%d", identity)
+	return NewRateByExtractor(name, clientCertExtractor{identity}, failCode, failMsg)
+}
+
+// Reports whether the route rate limits by nothing but a client certificate,
+// in which case requests without one are invalid rather than anonymous
+func onlyClientCert(route *Route) bool {
+	if len(route.Rates) != 1 {
+		return false
+	}
+	for by := range route.Rates {
+		_, ok := by.Extractor.(clientCertExtractor)
+		return ok
+	}
+	return false
+}
+
+// Create a TLS configuration for a server that verifies client certificates
+// against the PEM encoded CA certificates in the file at caFile. Clients
+// aren't required to present a certificate during the handshake, so that
+// routes that don't rate limit by client certificate keep working for them.
+func ClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
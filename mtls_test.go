@@ -0,0 +1,240 @@
+package ursa
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Creates a certificate signed by parent. If parent is nil, the certificate is
+// self signed.
+func createCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertRateBy(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := createCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	spiffe, _ := url.Parse("spiffe://example.com/partner/acme")
+	client, clientKey := createCert(t, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "acme", Organization: []string{"Acme"}},
+		DNSNames:       []string{"partner.acme.com"},
+		EmailAddresses: []string{"ops@acme.com"},
+		URIs:           []*url.URL{spiffe},
+		NotAfter:       notAfter,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	// A certificate of the CA with only a subject
+	bare, bareKey := createCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "bare"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	// A certificate not signed by the CA
+	stranger, strangerKey := createCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "stranger"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)
+	tlsConf, err := ClientCertTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var by *RateBy
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig, err := by.Extract(r.Context(), r)
+		if errors.Is(err, ErrNoValue) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, ErrInvalidValue) {
+			w.WriteHeader(by.FailCode)
+			return
+		}
+		io.WriteString(w, sig)
+	}))
+	srv.TLS = tlsConf
+	srv.StartTLS()
+	defer srv.Close()
+
+	request := func(cert *x509.Certificate, key *ecdsa.PrivateKey) (int, string) {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{
+				{Certificate: [][]byte{cert.Raw}, PrivateKey: key},
+			}
+		}
+		rsp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body)
+	}
+
+	spki := sha256.Sum256(client.RawSubjectPublicKeyInfo)
+	type test struct {
+		identity CertIdentity
+		cert     *x509.Certificate
+		key      *ecdsa.PrivateKey
+		expCode  int
+		expSig   string
+	}
+	tests := []test{
+		{identity: CertSubject, cert: client, key: clientKey, expCode: 200, expSig: "CN=acme,O=Acme"},
+		{identity: CertDNSName, cert: client, key: clientKey, expCode: 200, expSig: "partner.acme.com"},
+		{identity: CertEmailAddress, cert: client, key: clientKey, expCode: 200, expSig: "ops@acme.com"},
+		{identity: CertURI, cert: client, key: clientKey, expCode: 200, expSig: spiffe.String()},
+		{identity: CertSPKIFingerprint, cert: client, key: clientKey, expCode: 200, expSig: hex.EncodeToString(spki[:])},
+		{identity: CertSubject, expCode: http.StatusUnauthorized},
+		{identity: CertDNSName, cert: bare, key: bareKey, expCode: http.StatusForbidden},
+		// Client doesn't send a certificate that isn't issued by the CAs the
+		// server accepts, so it's treated like a request without certificate
+		{identity: CertSubject, cert: stranger, key: strangerKey, expCode: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		by = NewRateByClientCert(test.identity, http.StatusForbidden, "Forbidden")
+		code, sig := request(test.cert, test.key)
+		if code != test.expCode || sig != test.expSig {
+			t.Errorf("identity %d: expected %v %q got %v %q", test.identity, test.expCode, test.expSig, code, sig)
+		}
+	}
+}
+
+func TestClientCertWithOtherRateBys(t *testing.T) {
+	ca, caKey := createCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := createCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "acme"},
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600)
+	tlsConf, err := ClientCertTLSConfig(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, stop := testUpstream()
+	defer stop()
+
+	byUser := NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 401, "")
+	byCert := NewRateByClientCert(CertSubject, http.StatusForbidden, "")
+	s := New(Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			{
+				Methods:  []string{"GET"},
+				Template: "/",
+				Rates:    RouteRates{byUser: NewRate(100, Hour), byCert: NewRate(2, Hour)},
+			},
+			{
+				Methods:  []string{"GET"},
+				Template: "/partners",
+				Rates:    RouteRates{byCert: NewRate(100, Hour)},
+			},
+		},
+	})
+	srv := httptest.NewUnstartedServer(s)
+	srv.TLS = tlsConf
+	srv.StartTLS()
+	defer srv.Close()
+
+	request := func(path string, withCert bool, user string) *http.Response {
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		if withCert {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{
+				{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey},
+			}
+		}
+		r, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if user != "" {
+			r.Header.Set("User", user)
+		}
+		rsp, err := (&http.Client{Transport: transport}).Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp
+	}
+
+	// The RateBys of the route are tried in random order, so requests are
+	// sent several times
+	for i := 0; i < 10; i++ {
+		if code := request("/", false, "alice").StatusCode; code != 200 {
+			t.Errorf("request %d: expected a request with a header but no certificate to be allowed, got %v", i, code)
+		}
+		if code := request("/", false, "").StatusCode; code != HeaderValueNotFoundInRequestForRateLimiting {
+			t.Errorf("request %d: expected a request with neither to be anonymous, got %v", i, code)
+		}
+	}
+	codes := []int{request("/", true, "").StatusCode, request("/", true, "").StatusCode, request("/", true, "").StatusCode}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != 429 {
+		t.Errorf("expected the certificate to be rate limited, got %v", codes)
+	}
+
+	// On a route rate limited by nothing but the certificate, requests
+	// without one get the fail code of the RateBy
+	if rsp := request("/partners", false, "alice"); rsp.StatusCode != http.StatusForbidden ||
+		rsp.Header.Get(ProblemTypeHeader) != ProblemInvalidValue {
+		t.Errorf("expected a request without certificate to be invalid, got %v %v", rsp.StatusCode, rsp.Header.Get(ProblemTypeHeader))
+	}
+	if code := request("/partners", true, "").StatusCode; code != 200 {
+		t.Errorf("expected a request with the certificate to be allowed, got %v", code)
+	}
+}
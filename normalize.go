@@ -0,0 +1,264 @@
+package ursa
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// How a trailing slash in the path of a request is treated. See
+// [ursa.PathNormalization]
+type TrailingSlash int
+
+const (
+	KeepTrailingSlash   TrailingSlash = iota // /page/ and /page are different paths
+	StripTrailingSlash                       // /page/ is the same as /page
+	AppendTrailingSlash                      // /page is the same as /page/
+)
+
+// Before a request is matched to a route, its path is normalized so that
+// different ways of writing the same path can't be used to match a different
+// route, or no route at all, and bypass rate limiting. The normalized path is
+// also the one sent upstream. Normalization:
+//
+//   - Decodes percent-encoded unreserved characters like %2E and %7E, and
+//     uppercases the hex digits of the rest. Other characters are kept encoded
+//     for the upstream. Requests with an encoded slash, %2F, are rejected with
+//     [ursa.InvalidPathHTTPCode], as an upstream that decodes it would see
+//     different segments than the ones the route was matched with.
+//   - Merges consecutive slashes, so /page//1 becomes /page/1.
+//   - Removes . and .. segments, so /page/./1 and /a/../page/1 become /page/1.
+//   - Applies the TrailingSlash policy.
+//   - If FoldCase is set, matches the path in lower case so that /PAGE/1 is
+//     the same as /page/1. The path sent upstream keeps its case. Templates
+//     and patterns must then be in lower case, or match case-insensitively
+//     using the (?i) flag, which [ursa.Validate] checks.
+//
+// RateBys see the normalized request, but RequestURI of the request is still
+// the one sent by the client, which is what [ursa.NewRateByHMAC] verifies the
+// signature of.
+//
+// Set Raw to match paths exactly as they are in the request. Raw is meant
+// for upstreams that treat the variants as different resources.
+type PathNormalization struct {
+	Raw           bool
+	TrailingSlash TrailingSlash
+	FoldCase      bool
+}
+
+// What to do with requests that ask for a different method using a method
+// override header like X-HTTP-Method-Override. See [ursa.MethodOverrideHeaders]
+type MethodOverride int
+
+const (
+	// Remove the method override headers before matching the request, so
+	// that upstream sees the request with the method it was matched with.
+	StripMethodOverride MethodOverride = iota
+	// Match POST requests using the method in the method override header,
+	// and send the header upstream. The header is removed from requests
+	// with other methods.
+	ApplyMethodOverride
+	// Reject requests with a method override header with
+	// [ursa.MethodOverrideRejectedHTTPCode]
+	RejectMethodOverride
+)
+
+// Headers that frameworks commonly use to override the method of a request
+var MethodOverrideHeaders = []string{
+	"X-HTTP-Method-Override",
+	"X-HTTP-Method",
+	"X-Method-Override",
+}
+
+const (
+	InvalidPathHTTPCode            = http.StatusBadRequest
+	MethodOverrideRejectedHTTPCode = http.StatusBadRequest
+)
+
+var (
+	errInvalidEscape = errors.New("invalid percent-encoding in path")
+	errEncodedSlash  = errors.New("encoded slash in path")
+)
+
+// Returns whether c is an unreserved character as defined in RFC 3986. Those
+// are the ones whose percent-encoding is equivalent to the character itself.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// Decodes the percent-encoded unreserved characters of the escaped path and
+// uppercases the hex digits of the other escapes. The path is decoded once
+// only, so a double encoded %252E stays %252E.
+func normalizeEscapes(escaped string) (string, error) {
+	if !strings.Contains(escaped, "%") {
+		return escaped, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(escaped); i++ {
+		c := escaped[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(escaped) {
+			return "", errInvalidEscape
+		}
+		hi, ok1 := unhex(escaped[i+1])
+		lo, ok2 := unhex(escaped[i+2])
+		if !ok1 || !ok2 {
+			return "", errInvalidEscape
+		}
+		decoded := hi<<4 | lo
+		if decoded == '/' {
+			return "", errEncodedSlash
+		}
+		if isUnreserved(decoded) {
+			b.WriteByte(decoded)
+		} else {
+			b.WriteString(strings.ToUpper(escaped[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// Returns the normalized form of the escaped path of a request. See
+// [ursa.PathNormalization]. Case is not folded.
+func normalizePath(escaped string, n PathNormalization) (string, error) {
+	if n.Raw || !strings.HasPrefix(escaped, "/") {
+		return escaped, nil
+	}
+	escaped, err := normalizeEscapes(escaped)
+	if err != nil {
+		return "", err
+	}
+	var segments []string
+	raw := strings.Split(escaped[1:], "/")
+	trailing := false
+	for i, seg := range raw {
+		last := i == len(raw)-1
+		switch seg {
+		case "":
+			trailing = last
+		case ".":
+			trailing = last
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+			trailing = last
+		default:
+			segments = append(segments, seg)
+		}
+	}
+	path := "/" + strings.Join(segments, "/")
+	if len(segments) == 0 {
+		return path, nil
+	}
+	switch {
+	case n.TrailingSlash == AppendTrailingSlash,
+		n.TrailingSlash == KeepTrailingSlash && trailing:
+		path += "/"
+	}
+	return path, nil
+}
+
+// Returns the request to send upstream, with the path normalized and the
+// method override headers handled as configured, and the method to match the
+// request with. If the request is to be rejected, the error tells how.
+func canonicalRequest(conf *Conf, r *http.Request) (*http.Request, string, *ErrReqSignature) {
+	override := ""
+	for _, h := range MethodOverrideHeaders {
+		if override = r.Header.Get(h); override != "" {
+			break
+		}
+	}
+	if override != "" && conf.MethodOverride == RejectMethodOverride {
+		return nil, "", &ErrReqSignature{
+			Code:    MethodOverrideRejectedHTTPCode,
+			Message: "method override not allowed",
+			Type:    ProblemMethodOverrideRejected,
+		}
+	}
+	invalidPath := &ErrReqSignature{
+		Code:    InvalidPathHTTPCode,
+		Message: "invalid path",
+		Type:    ProblemInvalidPath,
+	}
+	escaped, err := normalizePath(r.URL.EscapedPath(), conf.PathNormalization)
+	if err != nil {
+		return nil, "", invalidPath
+	}
+
+	method := r.Method
+	if override != "" && conf.MethodOverride == ApplyMethodOverride &&
+		r.Method == http.MethodPost {
+		method = strings.ToUpper(override)
+		override = ""
+	}
+	if escaped == r.URL.EscapedPath() && override == "" {
+		return r, method, nil
+	}
+
+	// The request is copied rather than modified as handlers must not modify
+	// the request they are given
+	c := r.WithContext(r.Context())
+	u := *r.URL
+	c.URL = &u
+	if escaped != r.URL.EscapedPath() {
+		path, err := url.PathUnescape(escaped)
+		if err != nil {
+			return nil, "", invalidPath
+		}
+		c.URL.Path, c.URL.RawPath = path, escaped
+	}
+	if override != "" {
+		// The override wasn't applied so upstream mustn't apply it either
+		c.Header = r.Header.Clone()
+		for _, h := range MethodOverrideHeaders {
+			c.Header.Del(h)
+		}
+	}
+	return c, method, nil
+}
+
+// Returns a literal of the pattern that has upper case letters and must be
+// matched case-sensitively, which a path in lower case never matches
+func upperCaseLiteral(pattern *regexp.Regexp) (string, bool) {
+	re, err := syntax.Parse(pattern.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var find func(re *syntax.Regexp) (string, bool)
+	find = func(re *syntax.Regexp) (string, bool) {
+		if re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0 {
+			lit := string(re.Rune)
+			if strings.ToLower(lit) != lit {
+				return lit, true
+			}
+		}
+		for _, sub := range re.Sub {
+			if lit, ok := find(sub); ok {
+				return lit, true
+			}
+		}
+		return "", false
+	}
+	return find(re)
+}
@@ -0,0 +1,191 @@
+package ursa
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	type test struct {
+		path  string
+		norm  PathNormalization
+		exp   string
+		isErr bool
+	}
+	strip := PathNormalization{TrailingSlash: StripTrailingSlash}
+	add := PathNormalization{TrailingSlash: AppendTrailingSlash}
+	tests := []test{
+		{path: "/page/1", exp: "/page/1"},
+		{path: "/page//1", exp: "/page/1"},
+		{path: "//page/1", exp: "/page/1"},
+		{path: "/page/./1", exp: "/page/1"},
+		{path: "/a/../page/1", exp: "/page/1"},
+		{path: "/../../page/1", exp: "/page/1"},
+		{path: "/page/%2E/1", exp: "/page/1"},
+		{path: "/page/%2e%2e/page/1", exp: "/page/1"},
+		{path: "/%70age/1", exp: "/page/1"},
+		{path: "/page%3f1", exp: "/page%3F1"},
+		// Upstream could decode an encoded slash into different segments
+		{path: "/page%2f1", isErr: true},
+		{path: "/x%2F..%2Fadmin", isErr: true},
+		{path: "/page%252E1", exp: "/page%252E1"},
+		{path: "/page/%zz", isErr: true},
+		{path: "/page/%2", isErr: true},
+		{path: "/page/", exp: "/page/"},
+		{path: "/page/.", exp: "/page/"},
+		{path: "/page/", norm: strip, exp: "/page"},
+		{path: "/page//", norm: strip, exp: "/page"},
+		{path: "/", norm: strip, exp: "/"},
+		{path: "/page", norm: add, exp: "/page/"},
+		{path: "/", norm: add, exp: "/"},
+		{path: "/page//./1", norm: PathNormalization{Raw: true}, exp: "/page//./1"},
+		{path: "*", exp: "*"},
+	}
+	for _, test := range tests {
+		got, err := normalizePath(test.path, test.norm)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("%v: expected error got %v", test.path, got)
+			}
+			continue
+		}
+		if err != nil || got != test.exp {
+			t.Errorf("%v: expected %v got %v (error %v)", test.path, test.exp, got, err)
+		}
+	}
+}
+
+func TestNormalizedPathsShareRoute(t *testing.T) {
+	var upstreamPaths []string
+	upstream, stop := testUpstream()
+	defer stop()
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{{
+			Methods:  []string{"GET"},
+			Template: "/page/{id}",
+			Rates:    RouteRates{RateByIP: NewRate(3, Hour)},
+		}},
+		PathNormalization: PathNormalization{FoldCase: true},
+	}
+	if hasError := ValidateConf(conf, false); hasError {
+		t.Fatal("expected configuration to be valid")
+	}
+	s := New(conf)
+	s.routing.Load().proxy.Director = func(r *http.Request) {
+		upstreamPaths = append(upstreamPaths, r.URL.EscapedPath())
+		r.URL.Scheme, r.URL.Host = upstream.Scheme, upstream.Host
+	}
+	paths := []string{"/page//1", "/page/./1", "/PAGE/1", "/%70age/1"}
+	for _, path := range paths[:3] {
+		if got := statusOf(s, httptest.NewRequest("GET", path, nil)); got != 200 {
+			t.Errorf("%v: expected 200 got %v", path, got)
+		}
+	}
+	if got := statusOf(s, httptest.NewRequest("GET", paths[3], nil)); got != 429 {
+		t.Errorf("%v: expected 429 got %v", paths[3], got)
+	}
+	// Case is only folded for matching
+	exp := []string{"/page/1", "/page/1", "/PAGE/1"}
+	for i := range exp {
+		if i >= len(upstreamPaths) || upstreamPaths[i] != exp[i] {
+			t.Errorf("expected upstream paths %v got %v", exp, upstreamPaths)
+			break
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{{
+			Methods: []string{"DELETE"},
+			Pattern: regexp.MustCompile(`^/items`),
+			Rates:   RouteRates{RateByIP: NewRate(1, Hour)},
+		}},
+	}
+
+	type test struct {
+		policy      MethodOverride
+		method      string
+		override    string
+		expCode     int
+		expUpstream string // Override header value seen by the upstream
+	}
+	tests := []test{
+		// Without applying the override, the POST doesn't match the route
+		{policy: StripMethodOverride, method: "POST", override: "DELETE", expCode: 200},
+		{policy: StripMethodOverride, method: "POST", override: "DELETE", expCode: 200},
+		{policy: ApplyMethodOverride, method: "POST", override: "delete", expCode: 200, expUpstream: "delete"},
+		{policy: ApplyMethodOverride, method: "POST", override: "DELETE", expCode: 429},
+		// Overrides of methods other than POST aren't applied
+		{policy: ApplyMethodOverride, method: "PUT", override: "DELETE", expCode: 200},
+		{policy: RejectMethodOverride, method: "POST", override: "DELETE", expCode: MethodOverrideRejectedHTTPCode},
+		{policy: RejectMethodOverride, method: "POST", expCode: 200},
+	}
+	var s *server
+	var seen string
+	for i, test := range tests {
+		if i == 0 || tests[i-1].policy != test.policy {
+			conf.MethodOverride = test.policy
+			s = New(conf)
+			s.routing.Load().proxy.Director = func(r *http.Request) {
+				seen = r.Header.Get("X-HTTP-Method-Override")
+				r.URL.Scheme, r.URL.Host = upstream.Scheme, upstream.Host
+			}
+		}
+		seen = ""
+		r := httptest.NewRequest(test.method, "/items", nil)
+		if test.override != "" {
+			r.Header.Set("X-HTTP-Method-Override", test.override)
+		}
+		if got := statusOf(s, r); got != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, got)
+		}
+		if seen != test.expUpstream {
+			t.Errorf("case %d: expected upstream to see override %q got %q", i, test.expUpstream, seen)
+		}
+	}
+}
+
+func TestFoldCaseRequiresLowerCaseRoutes(t *testing.T) {
+	type test struct {
+		route    Route
+		expField string
+	}
+	tests := []test{
+		{route: Route{Template: "/users/{userId}"}},
+		{route: Route{Template: "/Users/{id}"}, expField: "Template"},
+		{route: Route{Pattern: regexp.MustCompile(`^/users/(?P<ID>\d+)`)}},
+		{route: Route{Pattern: regexp.MustCompile(`^/Users`)}, expField: "Pattern"},
+		{route: Route{Pattern: regexp.MustCompile(`(?i)^/Users`)}},
+	}
+	for i, test := range tests {
+		test.route.Methods = []string{"GET"}
+		test.route.Rates = RouteRates{RateByIP: NewRate(1, Hour)}
+		conf := Conf{
+			Upstream:          upstream(),
+			Routes:            []Route{test.route},
+			PathNormalization: PathNormalization{FoldCase: true},
+		}
+		errs := Validate(conf)
+		if test.expField == "" && errs != nil {
+			t.Errorf("case %d: expected no errors got %v", i, errs)
+		}
+		if test.expField != "" && (len(errs) != 1 || errs[0].Field != test.expField) {
+			t.Errorf("case %d: expected an error in %v got %v", i, test.expField, errs)
+		}
+		// Case matters without FoldCase
+		conf.PathNormalization.FoldCase = false
+		if errs := Validate(conf); errs != nil {
+			t.Errorf("case %d: expected no errors without FoldCase got %v", i, errs)
+		}
+	}
+}
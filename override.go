@@ -0,0 +1,183 @@
+package ursa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An Override replaces the rate that applies to a client on a route until
+// the override expires. See [ursa.Overrides]
+type Override struct {
+	// Signature of the request the override applies to, as created by the
+	// RateBy the client is rate limited by. See [ursa.Overrides.Set]
+	Signature string `json:"signature"`
+	// Template or pattern of the route the override applies to, preceded by
+	// the Host of the route if it has one. Empty means all routes.
+	Route   string    `json:"route,omitempty"`
+	Rate    Rate      `json:"rate"`
+	Expires time.Time `json:"expires"`
+}
+
+type overrideKey struct {
+	sig   reqSignature
+	route string
+}
+
+// Overrides is a registry of temporary rates for individual clients, for
+// example to give a customer a bigger limit for a migration weekend or to
+// throttle an abusive key below its plan. Overrides take precedence over the
+// plan of the client and the rates of the route. Once an override expires,
+// the client gets the usual rate on its next request.
+//
+// Use it by setting Overrides of [ursa.Conf]. Overrides can be added and
+// removed while the server is running. If the registry is created with a
+// file, every change is written to the file so that the overrides survive
+// restarts.
+//
+// Overrides is safe for concurrent use.
+type Overrides struct {
+	file    string
+	entries map[overrideKey]Override
+	sync.RWMutex
+}
+
+// Create a registry of overrides. If file isn't empty, the overrides in the
+// file are loaded, if it exists, and every change to the registry is saved to
+// the file. An override in the file with an invalid rate is an error.
+func NewOverrides(file string) (*Overrides, error) {
+	o := &Overrides{file: file, entries: make(map[overrideKey]Override)}
+	if file == "" {
+		return o, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Override
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	now := time.Now()
+	for _, ov := range list {
+		if err := validateRate(ov.Rate); err != nil {
+			return nil, fmt.Errorf("%v: override of %v: %w", file, ov.Signature, err)
+		}
+		if now.Before(ov.Expires) {
+			o.entries[overrideKey{reqSignature(ov.Signature), ov.Route}] = ov
+		}
+	}
+	return o, nil
+}
+
+// Set the rate of the client with the given signature, as found by the RateBy
+// by, on the route with the given template or pattern until expires. An empty
+// route sets the rate on all routes that rate limit by the RateBy. An override
+// for a specific route takes precedence over the one for all routes. The rate
+// must have a positive capacity and refill duration.
+//
+// For example, to let the user with id 42 make 1000 requests an hour to
+// /reports until Monday:
+//
+//	overrides.Set(RateByUser, "42", "/reports", ursa.NewRate(1000, ursa.Hour), monday)
+func (o *Overrides) Set(by *RateBy, signature string, route string, rate Rate, expires time.Time) error {
+	if err := validateRate(rate); err != nil {
+		return err
+	}
+	sig := createReqSignature(by, signature)
+	o.Lock()
+	defer o.Unlock()
+	o.entries[overrideKey{sig, route}] = Override{
+		Signature: string(sig),
+		Route:     route,
+		Rate:      rate,
+		Expires:   expires,
+	}
+	return o.save()
+}
+
+// Delete the override of the client on the route if there is one
+func (o *Overrides) Delete(by *RateBy, signature string, route string) error {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.entries, overrideKey{createReqSignature(by, signature), route})
+	return o.save()
+}
+
+// List the overrides that haven't expired, ordered by signature and route
+func (o *Overrides) List() []Override {
+	now := time.Now()
+	o.RLock()
+	list := make([]Override, 0, len(o.entries))
+	for _, ov := range o.entries {
+		if now.Before(ov.Expires) {
+			list = append(list, ov)
+		}
+	}
+	o.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Signature != list[j].Signature {
+			return list[i].Signature < list[j].Signature
+		}
+		return list[i].Route < list[j].Route
+	})
+	return list
+}
+
+// Returns the rate that overrides the usual rate of the client with the given
+// request signature on the route.
+func (o *Overrides) rate(sig reqSignature, route string) (Rate, bool) {
+	now := time.Now()
+	o.RLock()
+	defer o.RUnlock()
+	for _, key := range [2]overrideKey{{sig, route}, {sig, ""}} {
+		if ov, ok := o.entries[key]; ok && now.Before(ov.Expires) {
+			return ov.Rate, true
+		}
+	}
+	return Rate{}, false
+}
+
+// Writes the overrides that haven't expired to the file of the registry. The
+// expired ones are removed. Must be called with the registry locked.
+func (o *Overrides) save() error {
+	now := time.Now()
+	list := make([]Override, 0, len(o.entries))
+	for key, ov := range o.entries {
+		if !now.Before(ov.Expires) {
+			delete(o.entries, key)
+			continue
+		}
+		list = append(list, ov)
+	}
+	if o.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash while writing doesn't
+	// leave a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(o.file), filepath.Base(o.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.file)
+}
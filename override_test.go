@@ -0,0 +1,134 @@
+package ursa
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	file := filepath.Join(t.TempDir(), "overrides.json")
+	overrides, err := NewOverrides(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byUser := NewRateBy("User",
+		func(string) bool { return true },
+		func(s string) string { return s },
+		http.StatusUnauthorized, "")
+	conf := Conf{
+		Upstream:  upstream,
+		Logfile:   io.Discard,
+		Overrides: overrides,
+		Routes: []Route{
+			{
+				Methods: []string{"GET"},
+				Pattern: regexp.MustCompile("^/reports"),
+				Rates:   RouteRates{byUser: NewRate(1, Hour)},
+			},
+			{
+				Methods: []string{"GET"},
+				Pattern: regexp.MustCompile("^/"),
+				Rates:   RouteRates{byUser: NewRate(1, Hour)},
+			},
+		},
+	}
+	s := New(conf)
+	request := func(user, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User", user)
+		return statusOf(s, r)
+	}
+
+	overrides.Set(byUser, "alice", "^/reports", NewRate(3, Hour), time.Now().Add(time.Hour))
+	overrides.Set(byUser, "bob", "", NewRate(2, Hour), time.Now().Add(time.Hour))
+	overrides.Set(byUser, "carol", "", NewRate(2, Hour), time.Now().Add(50*time.Millisecond))
+
+	type test struct {
+		user    string
+		path    string
+		sleep   time.Duration
+		expCode int
+	}
+	tests := []test{
+		{user: "alice", path: "/reports", expCode: 200},
+		{user: "alice", path: "/reports", expCode: 200},
+		{user: "alice", path: "/reports", expCode: 200},
+		{user: "alice", path: "/reports", expCode: 429},
+		// Override of alice only applies to /reports
+		{user: "alice", path: "/home", expCode: 200},
+		{user: "alice", path: "/home", expCode: 429},
+		{user: "bob", path: "/reports", expCode: 200},
+		{user: "bob", path: "/reports", expCode: 200},
+		{user: "bob", path: "/reports", expCode: 429},
+		{user: "bob", path: "/home", expCode: 200},
+		{user: "bob", path: "/home", expCode: 200},
+		{user: "carol", path: "/home", expCode: 200},
+		// Override of carol expires and she's back to 1 token, which she
+		// has already used
+		{user: "carol", path: "/home", sleep: 60 * time.Millisecond, expCode: 429},
+	}
+	for i, test := range tests {
+		time.Sleep(test.sleep)
+		if got := request(test.user, test.path); got != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, got)
+		}
+	}
+
+	// Overrides survive restarts
+	overrides.Delete(byUser, "bob", "")
+	loaded, err := NewOverrides(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := loaded.List()
+	if len(list) != 1 {
+		t.Fatalf("expected 1 override to be loaded got %v", list)
+	}
+	if got := list[0]; got.Signature != string(createReqSignature(byUser, "alice")) ||
+		got.Route != "^/reports" || got.Rate != NewRate(3, Hour) {
+		t.Errorf("loaded unexpected override %v", got)
+	}
+}
+
+func TestOverridesInvalidRate(t *testing.T) {
+	overrides, err := NewOverrides("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	type test struct {
+		rate  Rate
+		valid bool
+	}
+	tests := []test{
+		{rate: NewRate(0, Hour)},
+		{rate: NewRate(10, 0)},
+		{rate: NewRate(-1, Minute)},
+		{rate: NewRate(10, Minute), valid: true},
+	}
+	for i, test := range tests {
+		err := overrides.Set(RateByIP, "10.0.0.1", "", test.rate, expires)
+		if (err == nil) != test.valid {
+			t.Errorf("case %d: expected valid %v got error %v", i, test.valid, err)
+		}
+		file := filepath.Join(t.TempDir(), "overrides.json")
+		data, _ := json.Marshal([]Override{{Signature: "-10.0.0.1", Rate: test.rate, Expires: expires}})
+		os.WriteFile(file, data, 0o600)
+		if _, err := NewOverrides(file); (err == nil) != test.valid {
+			t.Errorf("case %d: expected valid %v when loading got error %v", i, test.valid, err)
+		}
+	}
+	if list := overrides.List(); len(list) != 1 {
+		t.Errorf("expected only the valid override to be set got %v", list)
+	}
+}
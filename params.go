@@ -0,0 +1,87 @@
+package ursa
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type pathParamsKey struct{}
+
+// Returns the values of the named capture groups of the route's pattern in
+// the given path. For the pattern `^/tenants/(?P<tenant>[^/]+)` and the path
+// /tenants/acme/users, it returns {"tenant": "acme"}.
+func pathParams(route *Route, path reqPath) map[string]string {
+	names := route.Pattern.SubexpNames()
+	match := route.Pattern.FindStringSubmatch(string(path))
+	params := make(map[string]string)
+	for i, name := range names {
+		if name != "" && i < len(match) {
+			params[name] = match[i]
+		}
+	}
+	return params
+}
+
+// Returns a copy of the context that holds the given path params
+func withPathParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, pathParamsKey{}, params)
+}
+
+// PathParam returns the value of the named capture group of the matched
+// route's pattern in the path of the request. It returns an empty string if
+// the pattern has no such group or it didn't participate in the match. It is
+// meant to be used by an [ursa.Extractor] with the context it receives.
+func PathParam(ctx context.Context, name string) string {
+	params, _ := ctx.Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+type pathParamExtractor struct {
+	name string
+}
+
+func (e pathParamExtractor) Extract(ctx context.Context, _ *http.Request) (string, error) {
+	val := PathParam(ctx, e.name)
+	if val == "" {
+		return "", ErrNoValue
+	}
+	return val, nil
+}
+
+// Create a RateBy that uses the value of the named capture group of the
+// route's pattern as the signature. This is useful for limits that apply to a
+// resource as a whole, no matter who makes the request. For example, to allow
+// 1000 requests an hour to each tenant shared by all of its users:
+//
+//	RateByTenant := ursa.NewRateByPathParam("tenant")
+//	route := ursa.Route{
+//		Methods: []string{"GET"},
+//		Pattern: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)`),
+//		Rates:   ursa.RouteRates{RateByTenant: ursa.NewRate(1000, ursa.Hour)},
+//	}
+//
+// To give each client a separate limit per tenant instead, see BucketBy of
+// [ursa.Route].
+func NewRateByPathParam(name string) *RateBy {
+	return NewRateByExtractor("path:"+name, pathParamExtractor{name}, http.StatusBadRequest, "")
+}
+
+// Returns the part of the bucket id that comes from the capture groups in
+// BucketBy of the route. Values are quoted so that no two different sets of
+// values give the same suffix.
+func bucketIdSuffix(route *Route, path reqPath) string {
+	if len(route.BucketBy) == 0 {
+		return ""
+	}
+	params := pathParams(route, path)
+	var b strings.Builder
+	for _, name := range route.BucketBy {
+		b.WriteString("|")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strconv.Quote(params[name]))
+	}
+	return b.String()
+}
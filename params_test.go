@@ -0,0 +1,88 @@
+package ursa
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestBucketByCaptureGroups(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	byUser := NewRateBy("User",
+		func(string) bool { return true },
+		func(s string) string { return s },
+		http.StatusUnauthorized, "")
+	byTenant := NewRateByPathParam("tenant")
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			{
+				// Each user gets one token per tenant
+				Methods:  []string{"GET"},
+				Pattern:  regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)/users`),
+				Rates:    RouteRates{byUser: NewRate(1, Hour)},
+				BucketBy: []string{"tenant"},
+			},
+			{
+				// Each tenant gets two tokens, shared by all users
+				Methods: []string{"GET"},
+				Pattern: regexp.MustCompile(`^/tenants/(?P<tenant>[^/]+)/reports`),
+				Rates:   RouteRates{byTenant: NewRate(2, Hour)},
+			},
+		},
+	}
+	if hasError := ValidateConf(conf, false); hasError {
+		t.Fatal("expected configuration to be valid")
+	}
+	s := New(conf)
+	request := func(user, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User", user)
+		return statusOf(s, r)
+	}
+
+	type test struct {
+		user    string
+		path    string
+		expCode int
+	}
+	tests := []test{
+		{user: "alice", path: "/tenants/acme/users", expCode: 200},
+		{user: "alice", path: "/tenants/acme/users/1", expCode: 429},
+		{user: "alice", path: "/tenants/globex/users", expCode: 200},
+		{user: "bob", path: "/tenants/acme/users", expCode: 200},
+		{user: "alice", path: "/tenants/acme/reports", expCode: 200},
+		{user: "bob", path: "/tenants/acme/reports", expCode: 200},
+		{user: "carol", path: "/tenants/acme/reports", expCode: 429},
+		{user: "carol", path: "/tenants/globex/reports", expCode: 200},
+	}
+	for i, test := range tests {
+		if got := request(test.user, test.path); got != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, got)
+		}
+	}
+
+	// Bucketing by a group that doesn't exist is a configuration error
+	conf.Routes[0].BucketBy = []string{"org"}
+	if hasError := ValidateConf(conf, false); !hasError {
+		t.Error("expected configuration with unknown capture group to be invalid")
+	}
+}
+
+func TestBucketIdSuffix(t *testing.T) {
+	route := &Route{
+		Pattern:  regexp.MustCompile(`^/(?P<a>[^/]*)/(?P<b>[^/]*)$`),
+		BucketBy: []string{"a", "b"},
+	}
+	// Values that would give the same suffix if they were joined as they are
+	first := bucketIdSuffix(route, "/x|b=/")
+	second := bucketIdSuffix(route, "/x/|b=")
+	if first == second {
+		t.Errorf("expected different suffixes for different values got %v for both", first)
+	}
+}
@@ -0,0 +1,88 @@
+package ursa
+
+import "sync"
+
+// A PlanResolver tells which plan a client is on, for example free, pro or
+// enterprise, given the signature of the client. The rate for the plan on a
+// route is looked up in PlanRates of the route. See [ursa.Route]
+//
+// Plan is called on every request that is rate limited so that a change in
+// the plan of a client reaches the buckets of the client right away. It
+// should therefore be fast, for example by looking up an in memory table
+// like [ursa.PlanTable] that is updated in the background.
+type PlanResolver interface {
+	Plan(signature string) (plan string, ok bool)
+}
+
+// PlanTable is a [ursa.PlanResolver] backed by a map from signatures to plans
+// that can be changed while the server is running. It is safe for concurrent
+// use.
+type PlanTable struct {
+	plans map[string]string
+	sync.RWMutex
+}
+
+// Create a PlanTable with the given signature to plan mapping. plans may be
+// nil. The map is copied.
+func NewPlanTable(plans map[string]string) *PlanTable {
+	t := &PlanTable{plans: make(map[string]string, len(plans))}
+	for sig, plan := range plans {
+		t.plans[sig] = plan
+	}
+	return t
+}
+
+func (t *PlanTable) Plan(signature string) (string, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	plan, ok := t.plans[signature]
+	return plan, ok
+}
+
+// Set the plan of the client with the given signature
+func (t *PlanTable) Set(signature, plan string) {
+	t.Lock()
+	t.plans[signature] = plan
+	t.Unlock()
+}
+
+// Delete the plan of the client with the given signature so that the
+// default rates apply to the client
+func (t *PlanTable) Delete(signature string) {
+	t.Lock()
+	delete(t.plans, signature)
+	t.Unlock()
+}
+
+// Returns the rate that applies to the client with the given signature when
+// rate limited by the given RateBy on the route.
+//
+// An override in the configuration for the client takes precedence over
+// everything else. Otherwise, the plan of the client is resolved by the
+// PlanResolver of the RateBy, or if it has none, by the one in the
+// configuration. If the route defines a rate for the plan in PlanRates, that
+// rate is used. Otherwise it's the rate of the RateBy in the route's Rates, or
+// the rate for anonymous clients if the RateBy isn't in Rates.
+func rateFor(conf *Conf, route *Route, by *RateBy, signature string) Rate {
+	if conf.Overrides != nil {
+		sig := createReqSignature(by, signature)
+		if rate, ok := conf.Overrides.rate(sig, routeKey(route)); ok {
+			return rate
+		}
+	}
+	plans := by.Plans
+	if plans == nil {
+		plans = conf.Plans
+	}
+	if plans != nil && len(route.PlanRates) > 0 {
+		if plan, ok := plans.Plan(signature); ok {
+			if rate, ok := route.PlanRates[plan]; ok {
+				return rate
+			}
+		}
+	}
+	if rate, ok := route.Rates[by]; ok {
+		return rate
+	}
+	return route.Anonymous.Rate
+}
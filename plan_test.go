@@ -0,0 +1,86 @@
+package ursa
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+// Creates an upstream that responds with 200 to every request and returns
+// its url along with a function to stop it
+func testUpstream() (*url.URL, func()) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	u, _ := url.Parse(upstream.URL)
+	return u, upstream.Close
+}
+
+// Sends a request through the handler and returns the status code
+func statusOf(h http.Handler, r *http.Request) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec.Code
+}
+
+func TestPlanRates(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	byUser := NewRateBy("User",
+		func(string) bool { return true },
+		func(s string) string { return s },
+		http.StatusUnauthorized, "")
+	plans := NewPlanTable(map[string]string{"alice": "free"})
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Plans:    plans,
+		Routes: []Route{{
+			Methods:   []string{"GET"},
+			Pattern:   regexp.MustCompile("/"),
+			Rates:     RouteRates{byUser: NewRate(1, Hour)},
+			PlanRates: map[string]Rate{"free": NewRate(2, Hour), "pro": NewRate(5, Hour)},
+		}},
+	}
+	s := New(conf)
+	request := func(user string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User", user)
+		return statusOf(s, r)
+	}
+
+	type test struct {
+		user    string
+		setPlan string
+		expCode int
+	}
+	tests := []test{
+		// bob has no plan and gets the rate in Rates
+		{user: "bob", expCode: 200},
+		{user: "bob", expCode: 429},
+		// alice is on the free plan
+		{user: "alice", expCode: 200},
+		{user: "alice", expCode: 200},
+		{user: "alice", expCode: 429},
+		// alice upgrades to pro while her bucket exists. She used 2 and
+		// was punished by 1 token, so 2 of the 5 tokens are left.
+		{user: "alice", setPlan: "pro", expCode: 200},
+		{user: "alice", expCode: 200},
+		{user: "alice", expCode: 429},
+		// bob gets a plan
+		{user: "bob", setPlan: "free", expCode: 429},
+		{user: "bob", setPlan: "pro", expCode: 200},
+	}
+	for i, test := range tests {
+		if test.setPlan != "" {
+			plans.Set(test.user, test.setPlan)
+		}
+		if got := request(test.user); got != test.expCode {
+			t.Errorf("case %d: user %v expected code %v got %v", i, test.user, test.expCode, got)
+		}
+	}
+}
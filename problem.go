@@ -0,0 +1,141 @@
+package ursa
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Types of the problems in the responses ursa sends itself, rather than
+// proxying them from upstream. They are stable, so that clients can tell
+// problems apart by Type instead of by status or message.
+const (
+	// The client has run out of tokens
+	ProblemRateLimited = "urn:ursa:problem:rate-limited"
+	// The request carries nothing to rate limit by and the route rejects
+	// such requests. See [ursa.RejectAnonymous]
+	ProblemMissingValue = "urn:ursa:problem:missing-value"
+	// The value to rate limit by is invalid, like an unknown API key. The
+	// detail is FailMsg of the RateBy
+	ProblemInvalidValue = "urn:ursa:problem:invalid-value"
+	// The IP address of the client couldn't be found
+	ProblemInvalidClientIP = "urn:ursa:problem:invalid-client-ip"
+	// The validator of a RateBy failed to tell whether the value to rate
+	// limit by is valid. See [ursa.ValidatorFailedHTTPCode]
+	ProblemValidatorFailed = "urn:ursa:problem:validator-failed"
+	// The route has no rates. See [ursa.NoRateDefinedOnRouteHTTPCode]
+	ProblemNoRateDefined = "urn:ursa:problem:no-rate-defined"
+	// The path can't be normalized. See [ursa.InvalidPathHTTPCode]
+	ProblemInvalidPath = "urn:ursa:problem:invalid-path"
+	// The request has a method override header that isn't allowed. See
+	// [ursa.RejectMethodOverride]
+	ProblemMethodOverrideRejected = "urn:ursa:problem:method-override-rejected"
+	// The route has DenyAction
+	ProblemDenied = "urn:ursa:problem:denied"
+	// The route has MaintenanceAction
+	ProblemMaintenance = "urn:ursa:problem:maintenance"
+	// The request couldn't be sent upstream, or upstream didn't respond
+	ProblemUpstreamUnavailable = "urn:ursa:problem:upstream-unavailable"
+)
+
+// Header set by [ursa.WriteProblem] to the Type of the problem, so on every
+// error response ursa sends itself. Responses proxied from upstream, and
+// those written by a custom [ursa.RejectionHandler] that doesn't use
+// WriteProblem, don't have it, so clients can tell errors of ursa from those
+// of upstream. It is removed from responses of upstream that have it.
+const ProblemTypeHeader = "Ursa-Problem"
+
+// Content type of the problems, from RFC 7807
+const ProblemContentType = "application/problem+json"
+
+var problemTitles = map[string]string{
+	ProblemRateLimited:            "Rate limited",
+	ProblemMissingValue:           "Nothing to rate limit by",
+	ProblemInvalidValue:           "Invalid value to rate limit by",
+	ProblemInvalidClientIP:        "Invalid client IP address",
+	ProblemValidatorFailed:        "Validator failed",
+	ProblemNoRateDefined:          "No rate defined on route",
+	ProblemInvalidPath:            "Invalid path",
+	ProblemMethodOverrideRejected: "Method override not allowed",
+	ProblemDenied:                 "Denied",
+	ProblemMaintenance:            "Under maintenance",
+	ProblemUpstreamUnavailable:    "Upstream unavailable",
+}
+
+// Details of the problems whose callers may not have a more specific one
+var problemDetails = map[string]string{
+	ProblemRateLimited:            "The client has run out of requests, try again later",
+	ProblemMissingValue:           "The request has none of the values the route rate limits by",
+	ProblemInvalidValue:           "The value the route rate limits by is invalid",
+	ProblemInvalidClientIP:        "The IP address of the client couldn't be found",
+	ProblemValidatorFailed:        "The value the route rate limits by couldn't be validated, try again later",
+	ProblemNoRateDefined:          "The route has no rates to limit requests by",
+	ProblemInvalidPath:            "The path of the request is invalid",
+	ProblemMethodOverrideRejected: "Method override headers aren't allowed",
+	ProblemDenied:                 "Requests to the route aren't allowed",
+	ProblemMaintenance:            "The route is under maintenance, try again later",
+	ProblemUpstreamUnavailable:    "The upstream server couldn't be reached",
+}
+
+// A Problem is the body of the error responses ursa sends itself, in the
+// format of RFC 7807 "Problem Details for HTTP APIs". RetryAfter is an
+// extension member telling the seconds the client should wait before
+// retrying, as in the Retry-After header.
+type Problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// Responds with the problem. Type defaults to "about:blank" and Title to the
+// title of the Type, which for "about:blank" is the text of the status.
+// Detail defaults to a description of the Type for the types of ursa.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = problemTitles[p.Type]
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Detail == "" {
+		p.Detail = problemDetails[p.Type]
+	}
+	body, _ := json.Marshal(p)
+	body = append(body, '\n')
+	header := w.Header()
+	header.Set("Content-Type", ProblemContentType)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set(ProblemTypeHeader, p.Type)
+	if p.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(p.RetryAfter))
+	}
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// Returns the problem to respond with for the error
+func (e *ErrReqSignature) problem() Problem {
+	return Problem{Type: e.Type, Status: e.Code, Detail: e.Message}
+}
+
+// Removes the header from responses of upstream, which mustn't pass for
+// problems of ursa
+func stripProblemTypeHeader(rsp *http.Response) error {
+	rsp.Header.Del(ProblemTypeHeader)
+	return nil
+}
+
+// Returns the ErrorHandler of the reverse proxy, which responds with
+// ProblemUpstreamUnavailable when the request can't be proxied
+func upstreamErrorHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		logger.Error("proxying request failed", "path", r.URL.Path, "error", err)
+		WriteProblem(w, Problem{Type: ProblemUpstreamUnavailable, Status: http.StatusBadGateway})
+	}
+}
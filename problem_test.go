@@ -0,0 +1,125 @@
+package ursa
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Returns the problem in the body of the response, or the zero Problem if
+// the body isn't one
+func problemOf(rec *httptest.ResponseRecorder) Problem {
+	var p Problem
+	json.Unmarshal(rec.Body.Bytes(), &p)
+	return p
+}
+
+func TestWriteProblem(t *testing.T) {
+	type test struct {
+		problem   Problem
+		expType   string
+		expTitle  string
+		expDetail string
+	}
+	tests := []test{
+		{Problem{Type: ProblemDenied, Status: 403}, ProblemDenied, "Denied", problemDetails[ProblemDenied]},
+		{Problem{Type: ProblemDenied, Title: "Go away", Status: 403, Detail: "not you"}, ProblemDenied, "Go away", "not you"},
+		{Problem{Status: 418}, "about:blank", "I'm a teapot", ""},
+		{Problem{Type: "https://example.com/problems/quota", Status: 429}, "https://example.com/problems/quota", "Too Many Requests", ""},
+	}
+	for i, test := range tests {
+		rec := httptest.NewRecorder()
+		WriteProblem(rec, test.problem)
+		got := problemOf(rec)
+		if rec.Code != test.problem.Status || got.Status != test.problem.Status {
+			t.Errorf("case %d: expected status %v got %v and %v", i, test.problem.Status, rec.Code, got.Status)
+		}
+		if got.Type != test.expType || rec.Header().Get(ProblemTypeHeader) != test.expType {
+			t.Errorf("case %d: expected type %v got %v and %v", i, test.expType, got.Type, rec.Header().Get(ProblemTypeHeader))
+		}
+		if got.Title != test.expTitle {
+			t.Errorf("case %d: expected title %q got %q", i, test.expTitle, got.Title)
+		}
+		if got.Detail != test.expDetail {
+			t.Errorf("case %d: expected detail %q got %q", i, test.expDetail, got.Detail)
+		}
+		if contentType := rec.Header().Get("Content-Type"); contentType != ProblemContentType {
+			t.Errorf("case %d: expected content type %v got %v", i, ProblemContentType, contentType)
+		}
+	}
+}
+
+func TestProblems(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.Header().Set(ProblemTypeHeader, ProblemRateLimited)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstreamServer.Close()
+	upstream, _ := url.Parse(upstreamServer.URL)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable, _ := url.Parse(closed.URL)
+	closed.Close()
+
+	byKey := NewRateBy("Key", func(s string) bool { return s == "valid" }, func(s string) string { return s }, 401, "unknown key")
+	routes := []Route{
+		{Methods: []string{"GET"}, Template: "/fail", Action: AllowAction},
+		{Methods: []string{"GET"}, Template: "/denied", Action: DenyAction, Body: "no"},
+		{Methods: []string{"GET"}, Template: "/*", Rates: RouteRates{byKey: NewRate(1, Hour)}},
+	}
+	s := New(Conf{Upstream: upstream, Logfile: io.Discard, Routes: routes, MethodOverride: RejectMethodOverride})
+	down := New(Conf{Upstream: unreachable, Logfile: io.Discard, Routes: routes})
+
+	type test struct {
+		handler    http.Handler
+		path       string
+		header     http.Header
+		expCode    int
+		expType    string
+		expDetail  string
+		expRetries bool
+	}
+	tests := []test{
+		{handler: s, path: "/a", expCode: 401, expType: ProblemMissingValue, expDetail: problemDetails[ProblemMissingValue]},
+		{handler: s, path: "/a", header: http.Header{"Key": {"wrong"}}, expCode: 401, expType: ProblemInvalidValue, expDetail: "unknown key"},
+		{handler: s, path: "/a", header: http.Header{"Key": {"valid"}}, expCode: 200},
+		{handler: s, path: "/a", header: http.Header{"Key": {"valid"}}, expCode: 429, expType: ProblemRateLimited, expRetries: true},
+		{handler: s, path: "/denied", expCode: 403, expType: ProblemDenied, expDetail: "no"},
+		{handler: s, path: "/a", header: http.Header{"X-Http-Method-Override": {"DELETE"}}, expCode: 400, expType: ProblemMethodOverrideRejected},
+		// Errors of upstream are sent as they are, without the header even
+		// if upstream sets it
+		{handler: s, path: "/fail", expCode: 500},
+		{handler: down, path: "/fail", expCode: 502, expType: ProblemUpstreamUnavailable, expDetail: problemDetails[ProblemUpstreamUnavailable]},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		for k, v := range test.header {
+			r.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		test.handler.ServeHTTP(rec, r)
+		if rec.Code != test.expCode {
+			t.Errorf("case %d: expected code %v got %v", i, test.expCode, rec.Code)
+		}
+		if got := rec.Header().Get(ProblemTypeHeader); got != test.expType {
+			t.Errorf("case %d: expected %v header %q got %q", i, ProblemTypeHeader, test.expType, got)
+		}
+		if test.expType == "" {
+			continue
+		}
+		p := problemOf(rec)
+		if p.Type != test.expType || p.Status != test.expCode {
+			t.Errorf("case %d: expected problem %v with status %v got %+v", i, test.expType, test.expCode, p)
+		}
+		if p.Detail == "" || test.expDetail != "" && p.Detail != test.expDetail {
+			t.Errorf("case %d: expected detail %q got %q", i, test.expDetail, p.Detail)
+		}
+		if test.expRetries && (p.RetryAfter <= 0 || rec.Header().Get("Retry-After") == "") {
+			t.Errorf("case %d: expected when to retry got %+v", i, p)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package ursa
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type (
@@ -22,10 +25,14 @@ type Rate struct {
 // This is the error objec that is returned if the there is an error creating
 // request signature from a request. A request signature for an unathenticated
 // user may mean their IP address.
+//
+// The request is responded with a [ursa.Problem] with Code as its status,
+// Message as its detail and Type as its type.
 type ErrReqSignature struct {
 	Message    string
 	LogMessage string
 	Code       int
+	Type       string // Type of the problem, one of the Problem constants or a URI of your own
 }
 
 // This struct is made public for library authors, if you're writing a rate
@@ -35,9 +42,33 @@ type ErrReqSignature struct {
 // This struct may be made private in future versions. If you want to
 // perform rate limiting for unauthenticated users, [ursa.RateByIP] is
 // already provided for you
+//
+// The value to limit the rate by is read from the first non empty field among
+// Header, Cookie, Query and BodyField. If all of them are empty, the RateBy
+// performs rate limiting by IP just like [ursa.RateByIP].
+//
+// When Extractor is set, it is used to find the signature from the request
+// instead, and Header, Cookie, Query, BodyField, Valid and Signature fields
+// are ignored. See [ursa.NewRateByExtractor]
 type RateBy struct {
-	Header string // Header field to limit the rate by
-	Valid  func(string) bool
+	Name      string    // Name of the RateBy, required when Extractor is set
+	Extractor Extractor // Finds the signature from the request
+	Header    string    // Header field to limit the rate by
+	Cookie    string    // Cookie to limit the rate by
+	Query     string    // Query parameter to limit the rate by
+	BodyField string    // Field in JSON request body to limit the rate by, e.g. "user.id"
+	// MaxBodyBytes is the maximum number of bytes of the request body that
+	// are read when looking for BodyField. If the body is larger, the field
+	// is considered missing. Defaults to [ursa.DefaultMaxBodyBytes]
+	MaxBodyBytes int64
+	Valid        func(string) bool
+	// ValidateContext, if set, is used instead of Valid to check the value.
+	// It is useful when validation needs to query a database or an external
+	// service. See [ursa.Validator] and [ursa.NewCachingValidator]
+	ValidateContext Validator
+	// ValidateTimeout is the maximum time ValidateContext is allowed to take.
+	// Zero means no timeout other than that of the request.
+	ValidateTimeout time.Duration
 	// Signature is a function that converts the header value into
 	// something. Here Signature means the identity of the user/downstream
 	// client that this header value represents. For example if the header
@@ -48,6 +79,10 @@ type RateBy struct {
 	Signature func(string) string
 	FailCode  int    // Status code when the validation fails
 	FailMsg   string // Message to respond with if the validation fails
+	// Plans, if set, tells the plan of each client so that the rate that
+	// applies to the client can be chosen from the PlanRates of the route
+	// rather than Rates. See [ursa.PlanResolver]
+	Plans PlanResolver
 }
 
 // RouteRates is a map from RateBys for the route. This is a one of the things
@@ -71,6 +106,9 @@ const (
 	// Error of this status code is returned the desired header value
 	// is not found in the request when creating the request signature
 	HeaderValueNotFoundInRequestForRateLimiting = http.StatusUnauthorized
+	// Error of this status code is returned if the validator of a RateBy
+	// fails to tell whether the value in the request is valid or not
+	ValidatorFailedHTTPCode = http.StatusServiceUnavailable
 )
 
 // RateBy for rate limiting by IP. Note that that users using the same public
@@ -98,7 +136,80 @@ func NewRateBy(
 	failCode int,
 	failMsg string, // Message to respond if the validation of header value fails
 ) *RateBy {
-	return &RateBy{header, valid, signature, failCode, failMsg}
+	return &RateBy{
+		Header:    header,
+		Valid:     valid,
+		Signature: signature,
+		FailCode:  failCode,
+		FailMsg:   failMsg,
+	}
+}
+
+// Create a new RateBy based on the value of a cookie. This is useful for
+// browser clients that are identified by a session cookie.
+//
+// Params are same as that of [ursa.NewRateBy] except that cookie is the name
+// of the cookie to perform rate limiting by.
+func NewRateByCookie(
+	cookie string,
+	valid IsValidHeaderValue,
+	signature SignatureFromHeaderValue,
+	failCode int,
+	failMsg string,
+) *RateBy {
+	return &RateBy{
+		Cookie:    cookie,
+		Valid:     valid,
+		Signature: signature,
+		FailCode:  failCode,
+		FailMsg:   failMsg,
+	}
+}
+
+// Create a new RateBy based on the value of a query parameter, for example
+// the api_key in /products?api_key=xyz
+//
+// Params are same as that of [ursa.NewRateBy] except that param is the name
+// of the query parameter to perform rate limiting by.
+func NewRateByQuery(
+	param string,
+	valid IsValidHeaderValue,
+	signature SignatureFromHeaderValue,
+	failCode int,
+	failMsg string,
+) *RateBy {
+	return &RateBy{
+		Query:     param,
+		Valid:     valid,
+		Signature: signature,
+		FailCode:  failCode,
+		FailMsg:   failMsg,
+	}
+}
+
+// Create a new RateBy based on the value of a field in JSON request body.
+// Nested fields can be selected by separating names by dot as in "client.id".
+// At most maxBytes of the body are read, if maxBytes is 0,
+// [ursa.DefaultMaxBodyBytes] is used. The body is left intact so that it
+// can be proxied to the upstream.
+//
+// Rest of the params are same as that of [ursa.NewRateBy]
+func NewRateByBodyField(
+	field string,
+	maxBytes int64,
+	valid IsValidHeaderValue,
+	signature SignatureFromHeaderValue,
+	failCode int,
+	failMsg string,
+) *RateBy {
+	return &RateBy{
+		BodyField:    field,
+		MaxBodyBytes: maxBytes,
+		Valid:        valid,
+		Signature:    signature,
+		FailCode:     failCode,
+		FailMsg:      failMsg,
+	}
 }
 
 // Create a Rate object
@@ -117,41 +228,19 @@ func NewRate(amount int, time duration) Rate {
 	return Rate{amount, time}
 }
 
-func isMethodInMethods(candidate string, methods []string) bool {
-	for _, current := range methods {
-		if current == candidate {
-			return true
-		}
-	}
-	return false
-}
-
-// Returns the route on configuration that should be used for the a given
-// reqPath. If no matching rate is found, nil, is returned.
-func routeForPath(p reqPathAndMethod, conf *Conf) *Route {
-	path := p.path
-	method := p.method
-	// Search linearly through the routes in the configuration to find a
-	// pattern that matches reqPath. Note that speed won't be an issue here
-	// since this function is supposed to be memoized when using.
-	// Memoization should be possible since the configuration is not changed once loaded.
-	for _, r := range conf.Routes {
-		if r.Pattern.MatchString(string(path)) && isMethodInMethods(method, r.Methods) {
-			return &r
-		}
-	}
-	return nil
-}
-
 // Returns *rateBy, reqSignature, *ErrReqSignature for a *Route based on
 // *http.Request If the route contains no rates to apply for the request, send
 // appropriate error.
+//
+// RateBys of the route are tried until one finds a value in the request.
+// [ursa.RateByIP] is only used if none of other RateBys find a value. If none
+// of them do, Anonymous of the route tells what to do. A nil RateBy without
+// an error means that the request isn't rate limited.
 func getReqSignature(r *http.Request, route *Route) (*RateBy, reqSignature, *ErrReqSignature) {
+	ctx := r.Context()
 	var limitRateBy *RateBy
 	keySignature := ""
-	key := ""
-	var err *ErrReqSignature = nil
-	var keyReqSig reqSignature = ""
+	var err error
 	rateBysCount := 0
 
 	for by := range route.Rates {
@@ -160,43 +249,70 @@ func getReqSignature(r *http.Request, route *Route) (*RateBy, reqSignature, *Err
 			limitRateBy = RateByIP
 			continue
 		}
-		if val := r.Header.Get(by.Header); val != "" {
-			limitRateBy = by
-			key = val
-			break
+		sig, e := by.Extract(ctx, r)
+		if errors.Is(e, ErrNoValue) {
+			if !onlyClientCert(route) {
+				continue
+			}
+			e = fmt.Errorf("%w: %w", ErrInvalidValue, e)
 		}
+		limitRateBy = by
+		keySignature = sig
+		err = e
+		break
 	}
 
-	if limitRateBy == RateByIP {
-		k, e := clientIpAddr(r)
-		key = k
-		if e != nil {
-			err = &ErrReqSignature{Code: http.StatusBadRequest, Message: e.Error()}
+	if limitRateBy == nil && rateBysCount > 0 {
+		switch route.Anonymous.Policy {
+		case LimitAnonymousByIP:
+			limitRateBy = RateByIP
+		case LimitAnonymousTogether:
+			return anonymousRateBy, createReqSignature(anonymousRateBy, ""), nil
+		case AllowAnonymous:
+			return nil, "", nil
 		}
 	}
-	if limitRateBy != nil {
-		if !limitRateBy.Valid(key) {
-			err = &ErrReqSignature{Code: limitRateBy.FailCode, Message: limitRateBy.FailMsg}
-		}
-		keySignature = limitRateBy.Signature(key)
-		keyReqSig = createReqSignature(limitRateBy, keySignature)
-	} else {
+	if limitRateBy == RateByIP {
+		keySignature, err = RateByIP.Extract(ctx, r)
+	}
+	if limitRateBy == nil {
 		if rateBysCount == 0 {
-			err = &ErrReqSignature{
+			return nil, "", &ErrReqSignature{
 				Code:       NoRateDefinedOnRouteHTTPCode,
+				Type:       ProblemNoRateDefined,
 				LogMessage: fmt.Sprintf("No rate bys defined on route pattern %s", route.Pattern),
 			}
-		} else {
-			err = &ErrReqSignature{Code: HeaderValueNotFoundInRequestForRateLimiting}
 		}
+		return nil, "", route.Anonymous.rejection()
 	}
 	// If err exists return zero values for  rateBy and request signature
 	if err != nil {
-		return nil, "", err
+		var sigErr *ErrReqSignature
+		if errors.As(err, &sigErr) {
+			return nil, "", sigErr
+		}
+		if errors.Is(err, ErrInvalidValue) {
+			return nil, "", &ErrReqSignature{
+				Code:    limitRateBy.FailCode,
+				Message: limitRateBy.FailMsg,
+				Type:    ProblemInvalidValue,
+			}
+		}
+		return nil, "", &ErrReqSignature{
+			Code:       ValidatorFailedHTTPCode,
+			Type:       ProblemValidatorFailed,
+			LogMessage: fmt.Sprintf("validating %v failed: %v", limitRateBy.source(), err),
+		}
 	}
-	return limitRateBy, keyReqSig, err
+	return limitRateBy, createReqSignature(limitRateBy, keySignature), nil
 }
 
 func createReqSignature(by *RateBy, val string) reqSignature {
-	return reqSignature(fmt.Sprintf("%v-%v", by.Header, val))
+	return reqSignature(fmt.Sprintf("%v-%v", by.source(), val))
+}
+
+// Returns the signature that was used to create the request signature with
+// createReqSignature
+func signatureFromReqSignature(by *RateBy, sig reqSignature) string {
+	return strings.TrimPrefix(string(sig), by.source()+"-")
 }
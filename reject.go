@@ -0,0 +1,199 @@
+package ursa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// A Rejection describes a request that is rejected because its client ran
+// out of tokens
+type Rejection struct {
+	Route      *Route
+	RateBy     *RateBy
+	Signature  string // Signature of the client found by the RateBy
+	Rate       Rate   // Rate of the bucket of the client
+	Remaining  int    // Tokens left in the bucket, always 0 for rejections
+	Reset      int    // Seconds before the bucket has tokens again
+	RetryAfter int    // Seconds the client is told to wait before retrying
+}
+
+// A RejectionHandler responds to requests rejected because their client ran
+// out of tokens. It can write any status, headers and body. When it's called,
+// the RateLimit and Retry-After headers described by [ursa.RateLimitHeaders]
+// are already set on the response and can be changed. The Ursa-Problem header
+// is only set if the handler responds using [ursa.WriteProblem].
+//
+// A handler can be set for all the routes using RejectionHandler of
+// [ursa.Conf], and for a single route using RejectionHandler of
+// [ursa.Route]. Requests are rejected by [ursa.DefaultRejectionHandler] if
+// neither is set.
+type RejectionHandler func(w http.ResponseWriter, r *http.Request, rejection *Rejection)
+
+// Responds with 429 Too Many Requests and a [ursa.ProblemRateLimited]
+// problem telling when to try again
+func DefaultRejectionHandler(w http.ResponseWriter, _ *http.Request, rejection *Rejection) {
+	WriteProblem(w, Problem{
+		Type:       ProblemRateLimited,
+		Status:     http.StatusTooManyRequests,
+		Detail:     fmt.Sprintf("Rate limited. Try again in %v seconds", rejection.RetryAfter),
+		RetryAfter: rejection.RetryAfter,
+	})
+}
+
+// Returns the handler for the rejected requests of the route
+func (rt *routing) rejectionHandler(route *Route) RejectionHandler {
+	switch {
+	case route.RejectionHandler != nil:
+		return route.RejectionHandler
+	case rt.conf.RejectionHandler != nil:
+		return rt.conf.RejectionHandler
+	}
+	return DefaultRejectionHandler
+}
+
+// RejectionTemplates are the templates [ursa.NewRejectionResponder] writes
+// the body of the responses with. They are executed with the
+// [*ursa.Rejection], so that for example {{.RetryAfter}} is the seconds the
+// client should wait. The JSON template has a json function that writes a
+// value as JSON, as in {{json .Signature}}.
+type RejectionTemplates struct {
+	Text *template.Template
+	HTML *htmltemplate.Template
+	JSON *template.Template
+}
+
+// Functions available to the JSON template of [ursa.RejectionTemplates]
+var jsonTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Templates used for the ones left nil in [ursa.NewRejectionResponder]
+var DefaultRejectionTemplates = RejectionTemplates{
+	Text: template.Must(template.New("text").Parse(
+		"Rate limited. Try again in {{.RetryAfter}} seconds\n")),
+	HTML: htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Too Many Requests</title></head>
+<body>
+<h1>Too Many Requests</h1>
+<p>You can make {{.Rate.Capacity}} requests every {{.Rate.RefillDurationInSec}} seconds. Try again in {{.RetryAfter}} seconds.</p>
+</body>
+</html>
+`)),
+	JSON: template.Must(template.New("json").Funcs(jsonTemplateFuncs).Parse(
+		`{"error":"rate_limited","message":{{json (printf "Rate limited. Try again in %v seconds" .RetryAfter)}},` +
+			`"limit":{{.Rate.Capacity}},"window":{{.Rate.RefillDurationInSec}},"remaining":{{.Remaining}},"retryAfter":{{.RetryAfter}}}` + "\n")),
+}
+
+// Content types offered by the responder, in the order they are preferred
+// when the client accepts more than one equally
+var rejectionContentTypes = []string{"text/plain", "application/json", "text/html"}
+
+// Create a RejectionHandler that responds with 429 Too Many Requests and a
+// body written using the template for the content type that the Accept
+// header of the request prefers among plain text, JSON and HTML. Plain text
+// is used if the request has no Accept header or accepts none of them.
+// Templates left nil are taken from [ursa.DefaultRejectionTemplates].
+// Use [ursa.ParseJSONRejectionTemplate] to parse a JSON template that uses
+// the json function.
+func NewRejectionResponder(templates RejectionTemplates) RejectionHandler {
+	if templates.Text == nil {
+		templates.Text = DefaultRejectionTemplates.Text
+	}
+	if templates.HTML == nil {
+		templates.HTML = DefaultRejectionTemplates.HTML
+	}
+	if templates.JSON == nil {
+		templates.JSON = DefaultRejectionTemplates.JSON
+	}
+	return func(w http.ResponseWriter, r *http.Request, rejection *Rejection) {
+		var body bytes.Buffer
+		var err error
+		contentType := negotiate(r.Header.Values("Accept"), rejectionContentTypes)
+		switch contentType {
+		case "application/json":
+			err = templates.JSON.Execute(&body, rejection)
+		case "text/html":
+			err = templates.HTML.Execute(&body, rejection)
+		default:
+			err = templates.Text.Execute(&body, rejection)
+		}
+		if err != nil {
+			// A half written body is of no use, so the default message is
+			// sent instead
+			DefaultRejectionHandler(w, r, rejection)
+			return
+		}
+		w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write(body.Bytes())
+	}
+}
+
+// Parses a JSON template for [ursa.RejectionTemplates], making its json
+// function available
+func ParseJSONRejectionTemplate(text string) (*template.Template, error) {
+	return template.New("json").Funcs(jsonTemplateFuncs).Parse(text)
+}
+
+// Returns the offer the Accept headers prefer, or the first offer if they
+// accept none of them. Offers that are accepted equally are chosen in order.
+func negotiate(accept []string, offers []string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// Returns the quality with which the Accept headers accept the media type,
+// using the most specific range that matches it. No Accept header accepts
+// everything.
+func acceptQuality(accept []string, mediaType string) float64 {
+	if len(accept) == 0 {
+		return 1
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, header := range accept {
+		for _, item := range strings.Split(header, ",") {
+			rng, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err != nil {
+				continue
+			}
+			s := -1
+			switch {
+			case rng == mediaType:
+				s = 2
+			case rng == typ+"/*":
+				s = 1
+			case rng == "*/*":
+				s = 0
+			}
+			if s <= specificity {
+				continue
+			}
+			rangeQ := 1.0
+			if v, ok := params["q"]; ok {
+				if rangeQ, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			q, specificity = rangeQ, s
+		}
+	}
+	return q
+}
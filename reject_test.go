@@ -0,0 +1,141 @@
+package ursa
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestNegotiate(t *testing.T) {
+	type test struct {
+		accept   []string
+		expected string
+	}
+	tests := []test{
+		{nil, "text/plain"},
+		{[]string{"*/*"}, "text/plain"},
+		{[]string{"application/json"}, "application/json"},
+		{[]string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, "text/html"},
+		{[]string{"text/*"}, "text/plain"},
+		{[]string{"text/*, text/plain;q=0.1"}, "text/html"},
+		{[]string{"application/json;q=0.5", "text/html;q=0.9"}, "text/html"},
+		{[]string{"image/png"}, "text/plain"},
+		{[]string{"*/*;q=0.1, application/json;q=0"}, "text/plain"},
+		{[]string{"not a media type, application/json"}, "application/json"},
+	}
+	for i, test := range tests {
+		if got := negotiate(test.accept, rejectionContentTypes); got != test.expected {
+			t.Errorf("case %d: expected %v got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestRejectionHandler(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	byUser := NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 401, "")
+	var got *Rejection
+	conf := Conf{
+		Upstream: upstream,
+		Logfile:  io.Discard,
+		Routes: []Route{
+			{Methods: []string{"GET"}, Template: "/a", Rates: RouteRates{byUser: NewRate(1, Hour)}},
+			{
+				Methods:  []string{"GET"},
+				Template: "/b",
+				Rates:    RouteRates{byUser: NewRate(1, Hour)},
+				RejectionHandler: func(w http.ResponseWriter, _ *http.Request, _ *Rejection) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				},
+			},
+		},
+		RejectionHandler: func(w http.ResponseWriter, _ *http.Request, rejection *Rejection) {
+			got = rejection
+			w.Header().Set("X-Limited", "yes")
+			w.WriteHeader(http.StatusTeapot)
+		},
+	}
+	s := New(conf)
+	request := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User", "alice")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		return rec
+	}
+	request("/a")
+	rec := request("/a")
+	if rec.Code != http.StatusTeapot || rec.Header().Get("X-Limited") != "yes" {
+		t.Errorf("expected the response of the handler of the configuration got %v %v", rec.Code, rec.Header())
+	}
+	if got == nil || got.Route.Template != "/a" || got.RateBy != byUser || got.Signature != "alice" ||
+		got.Rate != NewRate(1, Hour) || got.Remaining != 0 || got.RetryAfter <= 0 {
+		t.Errorf("expected the rejection of alice on /a got %+v", got)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After to be set before the handler is called")
+	}
+	if got := rec.Header().Get(ProblemTypeHeader); got != "" {
+		t.Errorf("expected no %v header on the response of a custom handler got %q", ProblemTypeHeader, got)
+	}
+	request("/b")
+	if rec := request("/b"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the response of the handler of the route got %v", rec.Code)
+	}
+}
+
+func TestRejectionResponder(t *testing.T) {
+	rejection := &Rejection{Signature: `al"ice`, Rate: NewRate(10, Minute), RetryAfter: 42}
+	custom, err := ParseJSONRejectionTemplate(`{"client":{{json .Signature}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		templates      RejectionTemplates
+		accept         string
+		expContentType string
+		expBody        string
+	}
+	tests := []test{
+		{accept: "", expContentType: "text/plain", expBody: "Rate limited. Try again in 42 seconds\n"},
+		{accept: "text/html", expContentType: "text/html", expBody: "<p>You can make 10 requests every 60 seconds. Try again in 42 seconds.</p>"},
+		{accept: "application/json", expContentType: "application/json", expBody: `"retryAfter":42`},
+		{
+			templates:      RejectionTemplates{JSON: custom},
+			accept:         "application/json",
+			expContentType: "application/json",
+			expBody:        `{"client":"al\"ice"}`,
+		},
+		{
+			templates:      RejectionTemplates{Text: template.Must(template.New("").Parse("{{.Missing}}"))},
+			expContentType: "",
+			expBody:        "Rate limited. Try again in 42 seconds",
+		},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		NewRejectionResponder(test.templates)(rec, r, rejection)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("case %d: expected code 429 got %v", i, rec.Code)
+		}
+		contentType := rec.Header().Get("Content-Type")
+		if test.expContentType != "" && !strings.HasPrefix(contentType, test.expContentType) {
+			t.Errorf("case %d: expected content type %v got %v", i, test.expContentType, contentType)
+		}
+		if !strings.Contains(rec.Body.String(), test.expBody) {
+			t.Errorf("case %d: expected body containing %q got %q", i, test.expBody, rec.Body.String())
+		}
+		if test.expContentType == "application/json" && !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("case %d: expected valid JSON got %q", i, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package ursa
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A function that loads the configuration, for example from a file using the
+// jsonconf package
+type ConfLoader func() (Conf, error)
+
+// Reload replaces the configuration of the server with conf without
+// restarting it. If conf isn't valid, the problems are returned as
+// [ursa.ConfErrors] and the server keeps the configuration it has.
+//
+// Requests that arrived before the reload are handled using the old
+// configuration. The state of the buckets is kept: a bucket whose route is in
+// both configurations keeps its tokens, and is resized if its rate changed.
+// Routes are told apart by their template or pattern, host and conditions on
+// the request, so changing any of them starts the route over with full
+// buckets. Buckets of routes that are no longer in the configuration are
+// removed, and the gifters of rates no longer in use are stopped.
+//
+// Logfile of the configuration isn't changed by a reload.
+func (s *server) Reload(conf Conf) error {
+	if errs := Validate(conf); errs != nil {
+		return errs
+	}
+	conf.Logfile = s.routing.Load().conf.Logfile
+	s.logLint(conf)
+	rt := newRouting(conf, &s.logger)
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	for _, r := range ratesOfConf(rt.conf) {
+		s.gifterForRate(r)
+	}
+	s.routing.Store(rt)
+	s.logger.Info("reloaded configuration", "routes", len(rt.conf.Routes))
+	s.reconcileBuckets(rt.conf)
+	s.stopUnusedGifters(rt.conf)
+	return nil
+}
+
+// Removes or resizes the buckets that don't fit the configuration
+func (s *server) reconcileBuckets(conf *Conf) {
+	routes := make(map[string]*Route)
+	for _, r := range routesWithFallback(conf) {
+		// Like requests, buckets belong to the first of routes with the
+		// same id
+		if _, ok := routes[routeId(r)]; !ok {
+			routes[routeId(r)] = r
+		}
+	}
+	s.mu.RLock()
+	boxes := make([]*box, 0, len(s.boxes))
+	for _, bx := range s.boxes {
+		boxes = append(boxes, bx)
+	}
+	s.mu.RUnlock()
+
+	for _, bx := range boxes {
+		bx.Lock()
+		buckets := make([]*bucket, 0, len(bx.buckets))
+		for _, b := range bx.buckets {
+			buckets = append(buckets, b)
+		}
+		source := bx.rateBy.source()
+		bx.Unlock()
+		for _, b := range buckets {
+			route := routes[b.route]
+			var by *RateBy
+			if route != nil {
+				by = rateByWithSource(route, source)
+			}
+			if by == nil {
+				s.logger.Info("removing bucket of removed route", "bucket", b)
+				s.removeBucket(b)
+				continue
+			}
+			// The configuration might have been created anew, in which case
+			// the RateBy is a different one that finds the same signatures
+			bx.Lock()
+			bx.rateBy = by
+			bx.Unlock()
+			s.resizeBucket(b, rateFor(conf, route, by, signatureFromReqSignature(by, bx.id)))
+		}
+	}
+}
+
+// Returns the RateBy of the route that has the source, including the one
+// anonymous clients are limited by, or nil if the route doesn't rate limit by
+// such a RateBy
+func rateByWithSource(route *Route, source string) *RateBy {
+	for by := range route.Rates {
+		if by.source() == source {
+			return by
+		}
+	}
+	if by := route.anonymousRateBy(); by != nil && by.source() == source {
+		return by
+	}
+	return nil
+}
+
+// Removes the bucket from its gifter and its box
+func (s *server) removeBucket(b *bucket) {
+	b.Lock()
+	g := b.gifter
+	b.Unlock()
+	if g != nil {
+		// Gifter is locked before the bucket as is done when gifting
+		g.Lock()
+		b.Lock()
+		if b.gifter == g {
+			g.buckets.removeNode(b.node)
+			b.gifter, b.node = nil, nil
+		}
+		b.Unlock()
+		g.Unlock()
+	}
+	b.box.Lock()
+	if b.box.buckets[b.id] == b {
+		delete(b.box.buckets, b.id)
+	}
+	b.box.Unlock()
+}
+
+// Stops the gifters that have no buckets and whose rate isn't used by the
+// configuration
+func (s *server) stopUnusedGifters(conf *Conf) {
+	rates := ratesOfConf(conf)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, g := range s.gifters {
+		if _, ok := rates[id]; ok {
+			continue
+		}
+		g.Lock()
+		if g.buckets.head == nil {
+			s.logger.Info("stopping unused gifter", "gifter", g)
+			g.stop()
+			delete(s.gifters, id)
+		}
+		g.Unlock()
+	}
+}
+
+// Reload the configuration using load every time the process receives one of
+// the signals, SIGHUP by default. Errors that occur when loading or reloading
+// are passed to onError which may be nil. Call the returned function to stop
+// reloading, it returns once reloading has stopped.
+func (s *server) ReloadOnSignal(load ConfLoader, onError func(error), signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ch:
+			}
+			s.reloadWith(load, onError)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// Reload the configuration using load every time the file at path changes.
+// The file is checked every interval. Errors that occur when loading or
+// reloading are passed to onError which may be nil. Call the returned
+// function to stop watching, it returns once the watcher has stopped.
+func (s *server) WatchConfFile(path string, interval time.Duration, load ConfLoader, onError func(error)) (stop func()) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			s.reloadWith(load, onError)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+func (s *server) reloadWith(load ConfLoader, onError func(error)) {
+	conf, err := load()
+	if err == nil {
+		err = s.Reload(conf)
+	}
+	if err != nil {
+		s.logger.Error("reloading configuration failed", "error", err)
+		if onError != nil {
+			onError(err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package ursa
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+
+	confWith := func(routes ...Route) Conf {
+		return Conf{Upstream: upstream, Logfile: io.Discard, Routes: routes}
+	}
+	byUser := func() *RateBy {
+		return NewRateBy("User", func(string) bool { return true }, func(s string) string { return s }, 400, "")
+	}
+	users := Route{
+		Methods:  []string{"GET"},
+		Template: "/users",
+		Rates:    RouteRates{byUser(): NewRate(2, Hour)},
+	}
+	posts := Route{
+		Methods: []string{"GET"},
+		Pattern: regexp.MustCompile(`^/posts`),
+		Rates:   RouteRates{RateByIP: NewRate(3, Hour)},
+	}
+	s := New(confWith(users, posts))
+	request := func(path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("User", "alice")
+		return statusOf(s, r)
+	}
+	expectCodes := func(step string, path string, codes ...int) {
+		t.Helper()
+		for i, exp := range codes {
+			if got := request(path); got != exp {
+				t.Errorf("%v: request %d to %v: expected code %v got %v", step, i, path, exp, got)
+			}
+		}
+	}
+	expectCodes("before reload", "/users", 200)
+	expectCodes("before reload", "/posts", 200, 200)
+
+	// The same configuration created anew keeps the state of the buckets
+	users.Rates = RouteRates{byUser(): NewRate(2, Hour)}
+	if err := s.Reload(confWith(users, posts)); err != nil {
+		t.Fatal(err)
+	}
+	expectCodes("after identical reload", "/users", 200, 429)
+
+	// A bigger rate resizes the bucket keeping the used tokens used, and
+	// the removed route loses its bucket and gifter
+	users.Rates = RouteRates{byUser(): NewRate(5, Hour)}
+	if err := s.Reload(confWith(users)); err != nil {
+		t.Fatal(err)
+	}
+	expectCodes("after resize", "/users", 200, 200, 429)
+	s.mu.RLock()
+	_, ok := s.gifters[generateGifterId(NewRate(3, Hour))]
+	buckets := 0
+	for _, bx := range s.boxes {
+		bx.RLock()
+		buckets += len(bx.buckets)
+		bx.RUnlock()
+	}
+	s.mu.RUnlock()
+	if ok {
+		t.Error("expected the gifter of the removed rate to be stopped")
+	}
+	if buckets != 1 {
+		t.Errorf("expected only the bucket of the remaining route got %v buckets", buckets)
+	}
+	// Posts now aren't rate limited at all
+	expectCodes("after removing route", "/posts", 200, 200, 200, 200)
+
+	// Invalid configuration is rejected and the old one is kept
+	if err := s.Reload(Conf{Upstream: upstream}); !errors.Is(err, ErrInvalidConf) {
+		t.Errorf("expected ErrInvalidConf got %v", err)
+	}
+	expectCodes("after invalid reload", "/users", 429)
+}
+
+func TestReloadWhileServing(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+	conf := func(capacity int) Conf {
+		return Conf{
+			Upstream: upstream,
+			Logfile:  io.Discard,
+			Routes: []Route{{
+				Methods:  []string{"GET"},
+				Template: "/",
+				Rates:    RouteRates{RateByIP: NewRate(capacity, Hour)},
+			}},
+		}
+	}
+	s := New(conf(1000))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := statusOf(s, httptest.NewRequest("GET", "/", nil)); got != 200 {
+					t.Errorf("expected code 200 got %v", got)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := s.Reload(conf(1000 + i%2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestWatchConfFile(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+	path := filepath.Join(t.TempDir(), "capacity")
+	if err := os.WriteFile(path, []byte("1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	load := func() (Conf, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Conf{}, err
+		}
+		return Conf{
+			Upstream: upstream,
+			Logfile:  io.Discard,
+			Routes: []Route{{
+				Methods:  []string{"GET"},
+				Template: "/",
+				Rates:    RouteRates{RateByIP: NewRate(len(data), Hour)},
+			}},
+		}, nil
+	}
+	conf, _ := load()
+	s := New(conf)
+	stopWatching := s.WatchConfFile(path, 10*time.Millisecond, load, func(err error) {
+		t.Error(err)
+	})
+	defer stopWatching()
+
+	if err := os.WriteFile(path, []byte("333"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.routing.Load().conf.Routes[0].Rates[RateByIP] != NewRate(3, Hour) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the configuration in the file to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	upstream, stop := testUpstream()
+	defer stop()
+	var mu sync.Mutex
+	capacity := 1
+	load := func() (Conf, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return Conf{
+			Upstream: upstream,
+			Logfile:  io.Discard,
+			Routes: []Route{{
+				Methods:  []string{"GET"},
+				Template: "/",
+				Rates:    RouteRates{RateByIP: NewRate(capacity, Hour)},
+			}},
+		}, nil
+	}
+	conf, _ := load()
+	s := New(conf)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		signals []os.Signal // Signals to reload on, SIGHUP if none
+		send    os.Signal
+	}
+	tests := []test{
+		{send: syscall.SIGHUP},
+		{signals: []os.Signal{syscall.SIGUSR1}, send: syscall.SIGUSR1},
+	}
+	for i, test := range tests {
+		mu.Lock()
+		capacity++
+		exp := NewRate(capacity, Hour)
+		mu.Unlock()
+		stopReloading := s.ReloadOnSignal(load, func(err error) { t.Error(err) }, test.signals...)
+		if err := self.Signal(test.send); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for s.routing.Load().conf.Routes[0].Rates[RateByIP] != exp {
+			if time.Now().After(deadline) {
+				t.Fatalf("case %d: expected the configuration to be reloaded on %v", i, test.send)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stopReloading()
+	}
+}
@@ -0,0 +1,214 @@
+package ursa
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Default number of matched routes the server remembers. See RouteCacheSize
+// of [ursa.Conf]
+const DefaultRouteCacheSize = 10000
+
+// A node of the tree of route templates. Each node corresponds to a segment
+// of a path, so that the routes matching a path are found by walking down the
+// tree one segment at a time, no matter how many routes there are.
+type templateNode struct {
+	static   map[string]*templateNode // Children for literal segments
+	param    *templateNode            // Child for a {name} segment
+	routes   []int                    // Routes whose template ends at this node
+	wildcard []int                    // Routes whose template ends with * after this node
+}
+
+// Matches requests to the routes of a configuration. Routes with a Template
+// are matched using a tree of templates, the rest using their Pattern.
+type routeMatcher struct {
+	routes      []Route
+	methods     []methodSet // Methods of each route
+	tree        *templateNode
+	regexRoutes []int // Indices of routes without a Template, in order
+}
+
+// Splits the path into its segments. "/a/b" is split into ["a", "b"] and "/"
+// into [""].
+func pathSegments(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// Checks if the template is valid. A template is a path whose segments are
+// either literals, params written as {name}, or a * as the last segment.
+func parseTemplate(template string) ([]string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("template %q doesn't start with /", template)
+	}
+	segments := pathSegments(template)
+	names := make(map[string]bool)
+	for i, seg := range segments {
+		switch {
+		case seg == "*":
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("template %q has * before the last segment", template)
+			}
+		case strings.HasPrefix(seg, "{") || strings.HasSuffix(seg, "}"):
+			name := strings.TrimSuffix(strings.TrimPrefix(seg, "{"), "}")
+			if len(name) != len(seg)-2 || !paramNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("template %q has invalid param %q", template, seg)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("template %q has param %q more than once", template, name)
+			}
+			names[name] = true
+		case strings.ContainsAny(seg, "{}*"):
+			return nil, fmt.Errorf("template %q has invalid segment %q", template, seg)
+		}
+	}
+	return segments, nil
+}
+
+var paramNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Returns the regex equivalent to the template. Params become named capture
+// groups so that they can be used with BucketBy and [ursa.PathParam] just
+// like capture groups of a Pattern.
+func templateRegexp(template string) (*regexp.Regexp, error) {
+	segments, err := parseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for _, seg := range segments {
+		b.WriteString("/")
+		switch {
+		case seg == "*":
+			b.WriteString(".*")
+		case strings.HasPrefix(seg, "{"):
+			fmt.Fprintf(&b, "(?P<%s>[^/]+)", seg[1:len(seg)-1])
+		default:
+			b.WriteString(regexp.QuoteMeta(seg))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// Creates a matcher for the routes. Routes with a Template are given a
+// Pattern equivalent to the template. Expects the routes to be valid.
+func newRouteMatcher(routes []Route, customMethods []string) *routeMatcher {
+	m := &routeMatcher{routes: routes, tree: &templateNode{}}
+	for i := range routes {
+		r := &routes[i]
+		methods, _ := newMethodSet(r.Methods, customMethods)
+		m.methods = append(m.methods, methods)
+		if r.Template == "" {
+			m.regexRoutes = append(m.regexRoutes, i)
+			continue
+		}
+		r.Pattern, _ = templateRegexp(r.Template)
+		n := m.tree
+		segments, _ := parseTemplate(r.Template)
+		for j, seg := range segments {
+			if seg == "*" && j == len(segments)-1 {
+				n.wildcard = append(n.wildcard, i)
+				n = nil
+				break
+			}
+			n = n.child(seg)
+		}
+		if n != nil {
+			n.routes = append(n.routes, i)
+		}
+	}
+	return m
+}
+
+// Returns the child node for the template segment, creating it if needed
+func (n *templateNode) child(seg string) *templateNode {
+	if strings.HasPrefix(seg, "{") {
+		if n.param == nil {
+			n.param = &templateNode{}
+		}
+		return n.param
+	}
+	if n.static == nil {
+		n.static = make(map[string]*templateNode)
+	}
+	c, ok := n.static[seg]
+	if !ok {
+		c = &templateNode{}
+		n.static[seg] = c
+	}
+	return c
+}
+
+// Calls found with the index of every route whose template matches the
+// remaining segments of the path
+func (n *templateNode) collect(segments []string, found func(int)) {
+	for _, i := range n.wildcard {
+		if len(segments) > 0 {
+			found(i)
+		}
+	}
+	if len(segments) == 0 {
+		for _, i := range n.routes {
+			found(i)
+		}
+		return
+	}
+	seg, rest := segments[0], segments[1:]
+	if c, ok := n.static[seg]; ok {
+		c.collect(rest, found)
+	}
+	if n.param != nil && seg != "" {
+		n.param.collect(rest, found)
+	}
+}
+
+// Returns whether the route with the index matches the method and host of
+// the request
+func (m *routeMatcher) matchesMethodAndHost(i int, p reqPathAndMethod) bool {
+	return m.methods[i].contains(p.method) && hostMatches(m.routes[i].Host, p.host)
+}
+
+// Returns the indices of the routes that match the path, method and host of
+// the request, in the order they appear in the configuration. Routes after
+// the first one without conditions on the rest of the request are left out
+// as they can never be the first route to match.
+func (m *routeMatcher) match(p reqPathAndMethod) []int {
+	path := string(p.path)
+	var templates []int
+	if strings.HasPrefix(path, "/") {
+		m.tree.collect(pathSegments(path), func(i int) {
+			if m.matchesMethodAndHost(i, p) {
+				templates = append(templates, i)
+			}
+		})
+		sort.Ints(templates)
+	}
+	var candidates []int
+	// Adds the route to candidates and returns whether it's the last one
+	add := func(i int) bool {
+		candidates = append(candidates, i)
+		return !m.routes[i].hasRequestConditions()
+	}
+	t := 0
+	for _, i := range m.regexRoutes {
+		for ; t < len(templates) && templates[t] < i; t++ {
+			if add(templates[t]) {
+				return candidates
+			}
+		}
+		if m.routes[i].Pattern.MatchString(path) && m.matchesMethodAndHost(i, p) {
+			if add(i) {
+				return candidates
+			}
+		}
+	}
+	for ; t < len(templates); t++ {
+		if add(templates[t]) {
+			return candidates
+		}
+	}
+	return candidates
+}
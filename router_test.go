@@ -0,0 +1,118 @@
+package ursa
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestRouteMatcher(t *testing.T) {
+	rates := RouteRates{RateByIP: NewRate(10, Minute)}
+	routes := []Route{
+		{Methods: []string{"GET"}, Template: "/tenants/{tenant}/users", Rates: rates},
+		{Methods: []string{"POST"}, Template: "/tenants/{tenant}/users", Rates: rates},
+		{Methods: []string{"GET"}, Pattern: regexp.MustCompile(`^/tenants/admin`), Rates: rates},
+		{Methods: []string{"GET"}, Template: "/tenants/{tenant}", Rates: rates},
+		{Methods: []string{"GET"}, Template: "/static/*", Rates: rates},
+		{Methods: []string{"GET"}, Template: "/", Rates: rates},
+		{Methods: []string{"GET"}, Pattern: regexp.MustCompile(`/page/[^\/]+`), Rates: rates},
+		{Methods: []string{"GET"}, Template: "/{section}/latest", Rates: rates},
+	}
+	m := newRouteMatcher(routes, nil)
+
+	type test struct {
+		path     string
+		method   string
+		expRoute int // -1 for no route
+	}
+	tests := []test{
+		{path: "/tenants/acme/users", method: "GET", expRoute: 0},
+		{path: "/tenants/acme/users", method: "POST", expRoute: 1},
+		{path: "/tenants/acme/users", method: "DELETE", expRoute: -1},
+		{path: "/tenants/acme/users/1", method: "GET", expRoute: -1},
+		// The regex route comes before the template route that also matches
+		{path: "/tenants/admin", method: "GET", expRoute: 2},
+		{path: "/tenants/admin/users", method: "GET", expRoute: 0},
+		{path: "/tenants/acme", method: "GET", expRoute: 3},
+		{path: "/tenants/", method: "GET", expRoute: -1},
+		{path: "/static/", method: "GET", expRoute: 4},
+		{path: "/static/css/main.css", method: "GET", expRoute: 4},
+		{path: "/static", method: "GET", expRoute: -1},
+		{path: "/", method: "GET", expRoute: 5},
+		{path: "/page/1", method: "GET", expRoute: 6},
+		{path: "/blog/page/1", method: "GET", expRoute: 6},
+		{path: "/news/latest", method: "GET", expRoute: 7},
+		{path: "", method: "GET", expRoute: -1},
+	}
+	for _, test := range tests {
+		// None of the routes have conditions on the rest of the request, so
+		// the first candidate is the one that matches
+		var got, exp *Route
+		if candidates := m.match(reqPathAndMethod{reqPath(test.path), test.method, ""}); len(candidates) > 0 {
+			got = &routes[candidates[0]]
+		}
+		if test.expRoute >= 0 {
+			exp = &routes[test.expRoute]
+		}
+		if got != exp {
+			t.Errorf("%v %v: expected route %v got %v", test.method, test.path, exp, got)
+		}
+		// The pattern created for templates matches the same paths
+		if got != nil && !got.Pattern.MatchString(test.path) {
+			t.Errorf("%v %v: pattern %v of matched route doesn't match", test.method, test.path, got.Pattern)
+		}
+	}
+
+	if got := pathParams(&routes[0], "/tenants/acme/users"); got["tenant"] != "acme" {
+		t.Errorf("expected tenant param acme got %v", got)
+	}
+}
+
+func TestInvalidTemplates(t *testing.T) {
+	templates := []string{"tenants", "/{tenant", "/{}", "/{1st}", "/*/users", "/a*", "/{id}/{id}"}
+	for _, template := range templates {
+		if _, err := templateRegexp(template); err == nil {
+			t.Errorf("expected template %q to be invalid", template)
+		}
+	}
+
+	conf := Conf{
+		Upstream: &url.URL{Scheme: "http", Host: "localhost"},
+		Logfile:  io.Discard,
+		Routes: []Route{{
+			Methods:  []string{"GET"},
+			Template: "/tenants/{tenant}/users",
+			Rates:    RouteRates{RateByIP: NewRate(10, Minute)},
+			BucketBy: []string{"tenant"},
+		}},
+	}
+	if hasError := ValidateConf(conf, false); hasError {
+		t.Error("expected configuration with valid template to be valid")
+	}
+	conf.Routes[0].Template = "/tenants/{tenant/users"
+	if hasError := ValidateConf(conf, false); !hasError {
+		t.Error("expected configuration with invalid template to be invalid")
+	}
+}
+
+func BenchmarkRouteMatcher(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		routes := make([]Route, n)
+		for i := range routes {
+			routes[i] = Route{
+				Methods:  []string{"GET"},
+				Template: fmt.Sprintf("/api/resource%d/{id}", i),
+				Rates:    RouteRates{RateByIP: NewRate(10, Minute)},
+			}
+		}
+		m := newRouteMatcher(routes, nil)
+		p := reqPathAndMethod{reqPath(fmt.Sprintf("/api/resource%d/42", n-1)), "GET", ""}
+		b.Run(fmt.Sprintf("%d routes", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.match(p)
+			}
+		})
+	}
+}
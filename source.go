@@ -0,0 +1,112 @@
+package ursa
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Default maximum number of bytes of the request body that are read when
+// looking for a JSON body field. See [ursa.RateBy] MaxBodyBytes.
+const DefaultMaxBodyBytes int64 = 64 << 10
+
+// Returns the raw value to rate limit by from the request based on which of
+// the Header, Cookie, Query or BodyField field of the RateBy is set. An empty
+// string is returned if the value is not present in the request.
+func (by *RateBy) valueFrom(r *http.Request) string {
+	switch {
+	case by.Header != "":
+		return r.Header.Get(by.Header)
+	case by.Cookie != "":
+		c, err := r.Cookie(by.Cookie)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	case by.Query != "":
+		return r.URL.Query().Get(by.Query)
+	case by.BodyField != "":
+		return jsonBodyField(r, by.BodyField, by.MaxBodyBytes)
+	}
+	return ""
+}
+
+// Returns a name describing where the value of the RateBy is read from. The
+// name is used as a prefix for request signature so that same values read
+// from different places don't end up in the same box.
+func (by *RateBy) source() string {
+	switch {
+	case by.Extractor != nil:
+		return by.Name
+	case by.Header != "":
+		return by.Header
+	case by.Cookie != "":
+		return "cookie:" + by.Cookie
+	case by.Query != "":
+		return "query:" + by.Query
+	case by.BodyField != "":
+		return "body:" + by.BodyField
+	}
+	return ""
+}
+
+// Reads at most maxBytes of the request body and returns the value of the
+// given field in it if the body is a JSON object. Nested fields can be
+// selected by separating the names with a dot, as in "user.id". If the body
+// is larger than maxBytes, an empty string is returned.
+func jsonBodyField(r *http.Request, field string, maxBytes int64) string {
+	buf, ok := peekBody(r, maxBytes)
+	if !ok || len(buf) == 0 {
+		return ""
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return ""
+	}
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = obj[name]
+	}
+	switch val := v.(type) {
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case bool:
+		return fmt.Sprint(val)
+	}
+	return ""
+}
+
+// Reads the request body if it is at most maxBytes long. If maxBytes is 0,
+// [ursa.DefaultMaxBodyBytes] is used. The boolean returned is false if the
+// body is larger or couldn't be read.
+//
+// The bytes that are read are put back in front of the rest of the body so
+// that the request can still be forwarded upstream intact.
+func peekBody(r *http.Request, maxBytes int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBodyBytes
+	}
+	// Read one byte more than allowed to know if the body is too large
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil || int64(len(buf)) > maxBytes {
+		return nil, false
+	}
+	return buf, true
+}
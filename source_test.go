@@ -0,0 +1,69 @@
+package ursa
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValueFrom(t *testing.T) {
+	identity := func(s string) string { return s }
+	valid := func(s string) bool { return true }
+	byCookie := NewRateByCookie("session", valid, identity, 401, "")
+	byQuery := NewRateByQuery("api_key", valid, identity, 401, "")
+	byBody := NewRateByBodyField("client.id", 0, valid, identity, 401, "")
+	bySmallBody := NewRateByBodyField("id", 10, valid, identity, 401, "")
+
+	type test struct {
+		by     *RateBy
+		url    string
+		cookie *http.Cookie
+		body   string
+		expVal string
+	}
+	tests := []test{
+		{by: byCookie, url: "/", cookie: &http.Cookie{Name: "session", Value: "abc"}, expVal: "abc"},
+		{by: byCookie, url: "/", cookie: &http.Cookie{Name: "other", Value: "abc"}, expVal: ""},
+		{by: byCookie, url: "/", expVal: ""},
+		{by: byQuery, url: "/?api_key=xyz", expVal: "xyz"},
+		{by: byQuery, url: "/?key=xyz", expVal: ""},
+		{by: byBody, url: "/", body: `{"client": {"id": "c1"}}`, expVal: "c1"},
+		{by: byBody, url: "/", body: `{"client": {"id": 42}}`, expVal: "42"},
+		{by: byBody, url: "/", body: `{"client": "c1"}`, expVal: ""},
+		{by: byBody, url: "/", body: `not json`, expVal: ""},
+		{by: bySmallBody, url: "/", body: `{"id":"1"}`, expVal: "1"},
+		{by: bySmallBody, url: "/", body: `{"id": "123456789"}`, expVal: ""},
+	}
+	for _, test := range tests {
+		var body io.Reader
+		if test.body != "" {
+			body = strings.NewReader(test.body)
+		}
+		r, _ := http.NewRequest("POST", "https://example.com"+test.url, body)
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		got := test.by.valueFrom(r)
+		if got != test.expVal {
+			t.Errorf("expected value %q got %q for rateBy %v", test.expVal, got, test.by.source())
+		}
+		// Ensure the body is left intact for proxying
+		if test.body != "" {
+			b, _ := io.ReadAll(r.Body)
+			if string(b) != test.body {
+				t.Errorf("expected body %q to be intact, got %q", test.body, string(b))
+			}
+		}
+	}
+}
+
+func TestReqSignatureSource(t *testing.T) {
+	identity := func(s string) string { return s }
+	valid := func(s string) bool { return true }
+	byHeader := NewRateBy("session", valid, identity, 401, "")
+	byCookie := NewRateByCookie("session", valid, identity, 401, "")
+	if createReqSignature(byHeader, "a") == createReqSignature(byCookie, "a") {
+		t.Errorf("expected signatures from header and cookie of same name to differ")
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ursaserver/ursa/memoize"
@@ -22,21 +25,30 @@ type (
 type reqPathAndMethod struct {
 	path   reqPath
 	method string
+	host   string
 }
 
 type server struct {
 	id                string
-	conf              *Conf
-	rateBys           []*RateBy
+	routing           atomic.Pointer[routing]
 	bucketsStaleAfter time.Duration
 	boxes             map[reqSignature]*box
 	gifters           map[gifterId]*gifter
-	routeForPath      func(reqPathAndMethod) *Route
-	proxy             *httputil.ReverseProxy
 	mu                sync.RWMutex
+	reloadMu          sync.Mutex // Held while the configuration is reloaded
 	logger            slog.Logger
 }
 
+// The parts of the server that depend on the configuration. They are
+// replaced together when the configuration is reloaded, so that a request
+// sees either the old or the new configuration but never a mix of both.
+type routing struct {
+	conf          *Conf
+	rateBys       []*RateBy
+	routesForPath func(reqPathAndMethod) []int
+	proxy         *httputil.ReverseProxy
+}
+
 func (s *server) String() string {
 	return fmt.Sprintf("server %v", s.id)
 }
@@ -57,11 +69,14 @@ func (b *box) String() string {
 
 type bucket struct {
 	id           bucketId
+	route        string // Id of the route the bucket is for. See routeId
 	tokens       int
 	lastAccessed time.Time
 	lastGifted   time.Time
 	rate         *Rate
 	box          *box
+	gifter       *gifter        // Gifter the bucket is registered to, nil if none
+	node         *node[*bucket] // Node holding the bucket in gifter's buckets
 	sync.Mutex
 }
 
@@ -71,136 +86,180 @@ func (b *bucket) String() string {
 
 // Create a server based on provided configuration.
 // The server that is returned is a http.Handler as it implemements the ServerHTTP method
+//
+// If the configuration is invalid, the problems are printed and the process
+// exits. Use [ursa.NewServer] to handle them instead.
 func New(conf Conf) *server {
-	// Validates configuration. The validation func takes care of exist in case of error.
-	ValidateConf(conf, true)
+	s, err := NewServer(conf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return s
+}
+
+// Create a server based on provided configuration like [ursa.New], but
+// return the problems in an invalid configuration as [ursa.ConfErrors]
+// instead of exiting.
+func NewServer(conf Conf) (*server, error) {
+	if errs := Validate(conf); errs != nil {
+		return nil, errs
+	}
 	serverId := fmt.Sprintf("%v", rand.Float64())
-	s := &server{conf: &conf, id: serverId}
+	s := &server{id: serverId}
 	s.boxes = make(map[reqSignature]*box)
 	s.gifters = make(map[gifterId]*gifter)
 	s.bucketsStaleAfter = time.Duration(0)
-	s.proxy = httputil.NewSingleHostReverseProxy(conf.Upstream)
-	s.routeForPath = memoize.Unary(func(r reqPathAndMethod) *Route {
-		// Note that memoization is possible since the configuration is not
-		// changed once loaded.
-		return routeForPath(r, &conf)
-	})
 	// Create a logger
 	if conf.Logfile == nil {
 		conf.Logfile = os.Stdout
 	}
 	logger := slog.New(slog.NewTextHandler(conf.Logfile, nil))
 	s.logger = *logger
+	s.logLint(conf)
+	rt := newRouting(conf, &s.logger)
+	for _, r := range ratesOfConf(rt.conf) {
+		s.gifterForRate(r)
+	}
+	s.routing.Store(rt)
+	return s, nil
+}
+
+// Creates the routing for the configuration, which is expected to be valid
+func newRouting(conf Conf, logger *slog.Logger) *routing {
+	rt := &routing{conf: &conf}
+	// init reverse proxy
+	rt.proxy = httputil.NewSingleHostReverseProxy(conf.Upstream)
+	rt.proxy.ErrorHandler = upstreamErrorHandler(logger)
+	rt.proxy.ModifyResponse = stripProblemTypeHeader
+	// Groups are flattened into a new slice of routes, which also keeps the
+	// matcher from changing the routes of the caller when it fills in the
+	// patterns of the routes that have templates.
+	conf.Routes, conf.Groups = flatRoutes(conf), nil
+	conf.Fallback = fallbackRoute(conf)
+	matcher := newRouteMatcher(conf.Routes, conf.CustomMethods)
+	cacheSize := conf.RouteCacheSize
+	if cacheSize <= 0 {
+		cacheSize = DefaultRouteCacheSize
+	}
+	// Note that memoization is possible since the configuration is not
+	// changed once loaded, a reload creates a new routing instead. The
+	// cache is bounded since the paths and hosts requested are controlled
+	// by the clients.
+	rt.routesForPath = memoize.Bounded(matcher.match, cacheSize)
 	allRateBys := make(map[*RateBy]bool)
-	for _, route := range conf.Routes {
-		rates := route.Rates
-		for rateBy, r := range rates {
+	for _, route := range routesWithFallback(&conf) {
+		for rateBy := range route.Rates {
 			allRateBys[rateBy] = true
-			gifterId := generateGifterId(r)
-			// Check if the gifter with the id already exists
-			s.mu.RLock()
-			_, ok := s.gifters[gifterId]
-			s.mu.RUnlock()
-			if !ok {
-				// Create a gifter
-				g := &gifter{
-					rate:    r,
-					server:  s,
-					id:      gifterId,
-					buckets: new(linkedList[*bucket]),
-				}
-				s.mu.Lock()
-				s.gifters[gifterId] = g
-				s.mu.Unlock()
-			}
 		}
 	}
-	s.rateBys = make([]*RateBy, 0)
+	rt.rateBys = make([]*RateBy, 0)
 	for k := range allRateBys {
-		s.rateBys = append(s.rateBys, k)
+		rt.rateBys = append(rt.rateBys, k)
+	}
+	return rt
+}
+
+// Returns the routes of the configuration followed by its fallback route if
+// it has one
+func routesWithFallback(conf *Conf) []*Route {
+	routes := make([]*Route, 0, len(conf.Routes)+1)
+	for i := range conf.Routes {
+		routes = append(routes, &conf.Routes[i])
 	}
-	// Start gifters
-	for _, g := range s.gifters {
-		g.start()
+	if conf.Fallback != nil {
+		routes = append(routes, conf.Fallback)
+	}
+	return routes
+}
+
+// Returns the rates used by the routes of the configuration
+func ratesOfConf(conf *Conf) map[gifterId]Rate {
+	rates := make(map[gifterId]Rate)
+	for _, route := range routesWithFallback(conf) {
+		for _, r := range route.Rates {
+			rates[generateGifterId(r)] = r
+		}
+		for _, r := range route.PlanRates {
+			rates[generateGifterId(r)] = r
+		}
+		if route.anonymousRateBy() != nil {
+			rates[generateGifterId(route.Anonymous.Rate)] = route.Anonymous.Rate
+		}
+	}
+	return rates
+}
+
+// Logs the warnings of [ursa.Lint] for the configuration
+func (s *server) logLint(conf Conf) {
+	for _, w := range Lint(conf) {
+		s.logger.Warn("configuration might have a mistake", "warning", w.String())
 	}
-	// init reverse proxy
-	return s
 }
 
 // Checks if the provided configuration is valid.
 // If exitOnErr is true, prints all the error messages and exists the process
 // by calling os.Exit(1).
 // If exitOnErr is false then returns a boolean if the configuration is valid.
+//
+// To get the problems found as errors instead, use [ursa.Validate]
 func ValidateConf(conf Conf, exitOnErr bool) bool {
-	hasError := false
-	err := func() { hasError = true }
-	print := func(str string) {
-		if exitOnErr {
-			fmt.Println(str)
+	errs := Validate(conf)
+	if len(errs) > 0 && exitOnErr {
+		for _, err := range errs {
+			fmt.Println(err)
 		}
-		err()
-	}
-	if conf.Upstream == nil {
-		print("upstream url can't be nil")
-	}
-	if conf.Routes == nil {
-		print("routes cannot be nil")
-	} else if len(conf.Routes) == 0 {
-		print("zero routes")
-	} else {
-		for _, r := range conf.Routes {
-			if r.Pattern == nil {
-				msg := fmt.Sprintf("route %v pattern is nil", r)
-				print(msg)
-			}
-			if r.Rates == nil {
-				msg := fmt.Sprintf("route %v rates is nil", r)
-				print(msg)
-			} else if len(r.Rates) == 0 {
-				msg := fmt.Sprintf("no rates defined in route %v", r)
-				print(msg)
-			}
-			if r.Methods == nil {
-				msg := fmt.Sprintf("no headers defined in route %v", r)
-				print(msg)
-			} else if len(r.Methods) == 0 {
-				msg := fmt.Sprintf("length of allowed headers in route %v is 0", r)
-				print(msg)
-			}
-		}
-	}
-	if hasError && exitOnErr {
 		os.Exit(1)
 	}
-	return hasError
+	return len(errs) > 0
 }
 
 // This method makes the server a http.Handler
 // The logic of how a request to ursa server is handled is present in this
 // method
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := findPath(r)
-	// s.pathRate can be read safely without locking because it's never
-	// mutated once set during server initialization
-	route := s.routeForPath(reqPathAndMethod{path, r.Method})
+	// The request is handled using the configuration at the time it arrived
+	// even if the configuration is reloaded meanwhile
+	rt := s.routing.Load()
+	r, method, canonErr := canonicalRequest(rt.conf, r)
+	if canonErr != nil {
+		WriteProblem(w, canonErr.problem())
+		return
+	}
+	path := findPath(r, rt.conf.PathNormalization)
+	route := rt.routeForPath(r, reqPathAndMethod{path, method, requestHost(r)})
 
-	// If no route found, send request to upstream without rate limting
 	if route == nil {
-		s.proxy.ServeHTTP(w, r)
+		route = rt.conf.Fallback
+	}
+	// If no route found, send request to upstream without rate limting
+	if route == nil || route.Action == AllowAction {
+		rt.proxy.ServeHTTP(w, r)
 		return
 	}
+	if route.Action != LimitAction {
+		serveAction(w, route)
+		return
+	}
+
+	// Named capture groups of the pattern are made available to the
+	// extractors of RateBys. See ursa.PathParam
+	if route.Pattern.NumSubexp() > 0 {
+		r = r.WithContext(withPathParams(r.Context(), pathParams(route, path)))
+	}
 
 	rateBy, sig, err := getReqSignature(r, route)
 	if err != nil {
-		w.WriteHeader(err.Code)
-		if err.Message != "" {
-			fmt.Fprint(w, err.Message)
-		}
+		WriteProblem(w, err.problem())
 		if err.LogMessage != "" {
 			s.logger.Error(err.LogMessage)
 		}
 		return
 	}
+	if rateBy == nil {
+		rt.proxy.ServeHTTP(w, r)
+		return
+	}
 
 	s.logger.Info("got request at", "path", r.URL.Path)
 
@@ -227,7 +286,7 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	bx.RUnlock()
 	if !ok {
 		s.logger.Info("creating bucket for path", "path", path)
-		s.createBucket(path, bx, route, rateBy)
+		s.createBucket(rt.conf, path, bx, route, rateBy)
 	}
 
 	// At this position, we can safely assume that the gifter isn't deleting
@@ -237,24 +296,45 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	buck := bx.buckets[buckId]
 	bx.RUnlock()
 
+	// The rate that applies to the client might have changed since the
+	// bucket was created, for example if the client changed their plan.
+	rate := rateFor(rt.conf, route, rateBy, signatureFromReqSignature(rateBy, sig))
+	buck.Lock()
+	rateChanged := *buck.rate != rate
+	buck.Unlock()
+	if rateChanged {
+		s.logger.Info("resizing bucket", "bucket", buck, "rate", rate)
+		s.resizeBucket(buck, rate)
+	}
+
 	buck.Lock()
 	// We check if the no. of tokens is >= 1
 	// Note that by allowing the tokens to go below negative value, we're enforcing
 	// a punishment mechanism for when request is made when you're already rate limited.
 	buck.tokens--
+	now := time.Now()
+	state := buck.state(now)
+	headers := rt.conf.RateLimitHeaders
+	headers.set(w.Header(), state, now)
 	if buck.tokens < 0 {
-		// TODO enhance rejection message. Probably allow it to make customizable
 		// Note that by allowing the tokens to go below negative value, we're enforcing
 		// a punishment mechanism for when request is made when you're already rate limited.
-		tryAgainInSeconds := secondsBeforeSuccess(
-			time.Now(), buck.lastGifted, buck.rate, buck.tokens)
-		w.WriteHeader(http.StatusTooManyRequests)
-		fmt.Fprintf(w, "Rate limited. Try again in %v seconds", tryAgainInSeconds)
 		buck.Unlock()
+		tryAgainInSeconds := headers.retryAfter(state)
+		w.Header().Set("Retry-After", strconv.Itoa(tryAgainInSeconds))
+		rt.rejectionHandler(route)(w, r, &Rejection{
+			Route:      route,
+			RateBy:     rateBy,
+			Signature:  signatureFromReqSignature(rateBy, sig),
+			Rate:       state.rate,
+			Remaining:  state.remaining,
+			Reset:      state.reset,
+			RetryAfter: tryAgainInSeconds,
+		})
 		return
 	}
 	// Just before leaving, we set the last accessed time on the bucket
-	buck.lastAccessed = time.Now()
+	buck.lastAccessed = now
 	// Note that it's important to release this lock before calling ServeHTTP
 	// because we would otherwise be unnecessarily holding the lock until we get
 	// response from upstream and return that response. This is also the
@@ -263,20 +343,21 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// besides the critical section.
 	buck.Unlock()
 	// Call HTTPServer of the underlying ReverseProxy
-	s.proxy.ServeHTTP(w, r)
+	rt.proxy.ServeHTTP(w, r)
 }
 
 // Create a bucket with given id inside the given box.
 // Initializes various properties of the bucket like capacity, state time, etc.
 // and then registers the bucket to the gifter to collect gift tokens.
-func (s *server) createBucket(path reqPath, b *box, route *Route, by *RateBy) {
+func (s *server) createBucket(conf *Conf, path reqPath, b *box, route *Route, by *RateBy) {
 	b.Lock()
-	rate := route.Rates[by]
+	rate := rateFor(conf, route, by, signatureFromReqSignature(by, b.id))
 	acc := time.Now()
 	tokens := rate.Capacity
 	idForBucket := bucketIdForRoute(route, path)
 	newBucket := &bucket{
 		id:           idForBucket,
+		route:        routeId(route),
 		tokens:       tokens,
 		rate:         &rate,
 		lastAccessed: acc,
@@ -288,26 +369,123 @@ func (s *server) createBucket(path reqPath, b *box, route *Route, by *RateBy) {
 	s.logger.Info("created new bucket", "bucket", newBucket)
 	b.Unlock()
 
-	b.server.mu.RLock()
-	gifter, ok := b.server.gifters[generateGifterId(rate)]
-	b.server.mu.RUnlock()
-	if !ok {
-		// Since gifters are pregenerated for all rates, and rates
-		// don't change after the server is initialized, it's fatal
-		// to not find the gifter.
-		s.logger.Info("cannot find gifter for rate", "rate", rate)
+	s.addBucketToGifter(newBucket, rate)
+}
+
+// Adds the bucket to the gifter for the rate. If the gifter is stopped by a
+// reload meanwhile, the bucket is added to the gifter that replaces it.
+func (s *server) addBucketToGifter(b *bucket, rate Rate) {
+	for {
+		gifter := s.gifterForRate(rate)
+		s.logger.Info("adding bucket to appropriate gifter", "bucket", b, "gifter", gifter)
+		if gifter.addBucket(b) {
+			return
+		}
+	}
+}
+
+// Changes the rate of the bucket and moves it to the gifter of the new rate.
+// The tokens that were used from the bucket stay used, so a client that used 3
+// of 10 tokens has 97 tokens after an upgrade to 100 tokens.
+func (s *server) resizeBucket(b *bucket, rate Rate) {
+	b.Lock()
+	old := b.gifter
+	b.Unlock()
+	if old == nil {
+		// The bucket is being moved by another request or has been
+		// removed as stale
+		return
+	}
+	// Gifter is locked before the bucket as is done when gifting
+	old.Lock()
+	b.Lock()
+	if b.gifter != old || *b.rate == rate {
+		b.Unlock()
+		old.Unlock()
+		return
+	}
+	old.buckets.removeNode(b.node)
+	b.gifter, b.node = nil, nil
+	b.tokens = min(b.tokens+rate.Capacity-b.rate.Capacity, rate.Capacity)
+	b.rate = &rate
+	b.Unlock()
+	old.Unlock()
+	s.addBucketToGifter(b, rate)
+}
+
+// Returns the gifter for the given rate. If there is no gifter for the rate
+// yet, one is created and started. Gifters for the rates in the configuration
+// are created when the server is initialized but rates that depend on the
+// client, like the rate for a plan, may need a gifter later.
+func (s *server) gifterForRate(r Rate) *gifter {
+	id := generateGifterId(r)
+	s.mu.RLock()
+	g, ok := s.gifters[id]
+	s.mu.RUnlock()
+	if ok {
+		return g
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Check again as another request might have created the gifter while
+	// we were waiting for the lock
+	if g, ok := s.gifters[id]; ok {
+		return g
 	}
-	s.logger.Info("adding newly generated bucket to appropriate gifter", "gifter", gifter)
-	gifter.addBucket(newBucket)
+	g = &gifter{
+		rate:    r,
+		server:  s,
+		id:      id,
+		buckets: new(linkedList[*bucket]),
+	}
+	s.gifters[id] = g
+	g.start()
+	return g
 }
 
-// Gets path of the request. This is made a separte function in case there is
-// somethign to do with trailing slashes or such.
-func findPath(r *http.Request) reqPath {
+// Gets the path of the request to match routes with. The request is expected
+// to be normalized already. See [ursa.PathNormalization]
+func findPath(r *http.Request, n PathNormalization) reqPath {
+	if n.FoldCase && !n.Raw {
+		return reqPath(strings.ToLower(r.URL.Path))
+	}
 	return reqPath(r.URL.Path)
 }
 
-// Create bucket id for route
-func bucketIdForRoute(r *Route, _ reqPath) bucketId {
-	return bucketId(r.Pattern.String())
+// Returns the first route in the configuration that matches the request, or
+// nil if no route matches.
+func (rt *routing) routeForPath(r *http.Request, p reqPathAndMethod) *Route {
+	// rt.routesForPath can be called safely without locking because the
+	// routes are never mutated once the routing is created
+	for _, i := range rt.routesForPath(p) {
+		route := &rt.conf.Routes[i]
+		if !route.hasRequestConditions() || route.matchesRequest(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Create bucket id for route. Requests to paths that match the same route
+// share the bucket unless the route has BucketBy, in which case each value of
+// the capture groups in BucketBy gets its own bucket.
+func bucketIdForRoute(r *Route, path reqPath) bucketId {
+	return bucketId(routeId(r) + bucketIdSuffix(r, path))
+}
+
+// Returns the string that tells apart the routes whose buckets are separate.
+// Buckets are kept when the configuration is reloaded as long as there is a
+// route with the same id.
+func routeId(r *Route) string {
+	return routeKey(r) + conditionsKey(r)
+}
+
+// Returns the string that identifies the route, which is its template or
+// pattern, preceded by its host if it has one
+func routeKey(r *Route) string {
+	key := r.Template
+	if key == "" {
+		key = r.Pattern.String()
+	}
+	return strings.ToLower(r.Host) + key
 }
@@ -0,0 +1,66 @@
+package ursa
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ursaserver/ursa/memoize"
+)
+
+// A Validator checks if the value to perform rate limiting by, for example an
+// access token, is valid. Unlike the Valid field of [ursa.RateBy], it
+// receives a context, which is cancelled when the request is cancelled or
+// the ValidateTimeout of the RateBy passes, and it can return an error.
+//
+// A Validator must return nil if the value is valid and an error wrapping
+// [ursa.ErrInvalidValue] if it's not. Any other error means that the
+// validation couldn't be performed, for example because a database is
+// unreachable, and the request is responded with
+// [ursa.ValidatorFailedHTTPCode] instead of FailCode of the RateBy.
+type Validator func(ctx context.Context, value string) error
+
+// Create a Validator that remembers the results of validator.
+//
+// Valid values are remembered for positiveTTL and invalid ones for
+// negativeTTL. Failures of the validator, errors not wrapping
+// [ursa.ErrInvalidValue], are never remembered so that the value is validated
+// again once, say, the database is reachable. Concurrent validations of the
+// same value are deduplicated into a single call to validator.
+func NewCachingValidator(validator Validator, positiveTTL, negativeTTL time.Duration) Validator {
+	cached := memoize.Expiring(
+		func(ctx context.Context, value string) (struct{}, error) {
+			return struct{}{}, validator(ctx, value)
+		},
+		func(_ struct{}, err error) time.Duration {
+			switch {
+			case err == nil:
+				return positiveTTL
+			case errors.Is(err, ErrInvalidValue):
+				return negativeTTL
+			}
+			return 0
+		})
+	return func(ctx context.Context, value string) error {
+		_, err := cached(ctx, value)
+		return err
+	}
+}
+
+// Checks if value is valid using ValidateContext of the RateBy if it's set,
+// otherwise using Valid. The returned error wraps [ursa.ErrInvalidValue] if
+// the value is invalid.
+func (by *RateBy) validate(ctx context.Context, value string) error {
+	if by.ValidateContext == nil {
+		if !by.Valid(value) {
+			return ErrInvalidValue
+		}
+		return nil
+	}
+	if by.ValidateTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, by.ValidateTimeout)
+		defer cancel()
+	}
+	return by.ValidateContext(ctx, value)
+}
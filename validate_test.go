@@ -0,0 +1,72 @@
+package ursa
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateContext(t *testing.T) {
+	var calls atomic.Int32
+	errDBDown := errors.New("database down")
+	lookup := func(ctx context.Context, token string) error {
+		calls.Add(1)
+		switch token {
+		case "good":
+			return nil
+		case "slow":
+			<-ctx.Done()
+			return ctx.Err()
+		case "down":
+			return errDBDown
+		}
+		return ErrInvalidValue
+	}
+	byToken := &RateBy{
+		Header:          "Authorization",
+		ValidateContext: NewCachingValidator(lookup, time.Minute, time.Minute),
+		ValidateTimeout: 10 * time.Millisecond,
+		Signature:       func(s string) string { return s },
+		FailCode:        http.StatusUnauthorized,
+		FailMsg:         "Unauthorized",
+	}
+	route := &Route{
+		Pattern: regexp.MustCompile("/"),
+		Rates:   RouteRates{byToken: NewRate(10, Minute)},
+	}
+	type test struct {
+		token    string
+		expCode  int
+		expCalls int32
+	}
+	tests := []test{
+		{token: "good", expCode: 0, expCalls: 1},
+		{token: "good", expCode: 0, expCalls: 1},
+		{token: "bad", expCode: http.StatusUnauthorized, expCalls: 2},
+		{token: "bad", expCode: http.StatusUnauthorized, expCalls: 2},
+		// Validator failures are distinguished from invalid tokens, and
+		// aren't cached
+		{token: "down", expCode: ValidatorFailedHTTPCode, expCalls: 3},
+		{token: "down", expCode: ValidatorFailedHTTPCode, expCalls: 4},
+		{token: "slow", expCode: ValidatorFailedHTTPCode, expCalls: 5},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "https://example.com/", nil)
+		r.Header.Set("Authorization", test.token)
+		_, _, err := getReqSignature(r, route)
+		gotCode := 0
+		if err != nil {
+			gotCode = err.Code
+		}
+		if gotCode != test.expCode {
+			t.Errorf("token %q: expected code %v got %v", test.token, test.expCode, gotCode)
+		}
+		if c := calls.Load(); c != test.expCalls {
+			t.Errorf("token %q: expected %v calls to validator got %v", test.token, test.expCalls, c)
+		}
+	}
+}